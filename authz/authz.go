@@ -0,0 +1,223 @@
+/*
+Package authz resolves the Arborist resources a bearer token holds a permission on.
+It is shared by the gen3_writer and graphql_gen3 plugins, which pick an Authorizer
+through their plugin config:
+
+	authz: arborist | claims | static   (default arborist)
+	arborist_url: http://arborist-service
+	authz_service: peregrine            (Arborist service the permissions must be for, "*" for any)
+	authz_claim: authz                  (claims mode, JWT claim holding the mapping)
+	authz_resources: /programs/a/projects/b,...  (static mode, "*" or empty for all resources)
+
+Token signatures and expiry are checked by a Verifier when a JWKS is configured:
+
+	jwks_file: /etc/gen3/jwks.json
+	jwks_url: http://fence-service/.well-known/jwks
+*/
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AllResources stands for every resource. It is only handed out by the static authorizer
+const AllResources = "*"
+
+// Authorizer returns the resources the holder of a token has a permission (such as read,
+// create, update or delete) on. The token is the value of the Authorization header
+type Authorizer interface {
+	Resources(token string, method string) ([]string, error)
+}
+
+// Permission is a service and method pair as listed by Arborist auth/mapping
+type Permission struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+// Mapping is the Arborist auth/mapping response, resource paths to permissions
+type Mapping map[string][]Permission
+
+// Resources returns the sorted resources with a permission for the method on the service.
+// An empty service matches any service
+func (m Mapping) Resources(service string, method string) []string {
+	out := []string{}
+	for resource, permissions := range m {
+		for _, p := range permissions {
+			if (service == "" || service == "*" || p.Service == "*" || p.Service == service) &&
+				(p.Method == "*" || p.Method == method) {
+				out = append(out, resource)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Covers reports whether the resources grant access to a resource. A resource covers
+// itself and every resource below it, e.g. /programs/a covers /programs/a/projects/b
+func Covers(resources []string, resource string) bool {
+	for _, r := range resources {
+		if r == AllResources {
+			return true
+		}
+		r = strings.TrimSuffix(r, "/")
+		if resource == r || strings.HasPrefix(resource, r+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates the authorizer selected by the plugin config. defaultService is the
+// Arborist service used when authz_service is not set
+func New(config map[string]string, defaultService string) (Authorizer, error) {
+	service, ok := config["authz_service"]
+	if !ok {
+		service = defaultService
+	}
+	switch config["authz"] {
+	case "", "arborist":
+		url := config["arborist_url"]
+		if url == "" {
+			url = "http://arborist-service"
+		}
+		return NewArborist(url, service), nil
+	case "claims":
+		claim := config["authz_claim"]
+		if claim == "" {
+			claim = "authz"
+		}
+		return &ClaimsAuthorizer{Claim: claim, Service: service}, nil
+	case "static":
+		return NewStatic(config["authz_resources"]), nil
+	}
+	return nil, fmt.Errorf("unknown authz '%s', must be one of 'arborist', 'claims' or 'static'", config["authz"])
+}
+
+// ArboristAuthorizer asks Arborist for the auth/mapping of the token
+type ArboristAuthorizer struct {
+	URL     string
+	Service string
+	Client  *http.Client
+}
+
+func NewArborist(url string, service string) *ArboristAuthorizer {
+	return &ArboristAuthorizer{
+		URL:     strings.TrimSuffix(url, "/"),
+		Service: service,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (a *ArboristAuthorizer) Resources(token string, method string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, a.URL+"/auth/mapping", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Arborist auth/mapping GET returned a non-200 status code: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	mapping := Mapping{}
+	if err := json.Unmarshal(body, &mapping); err != nil {
+		return nil, fmt.Errorf("parsing Arborist auth/mapping: %s", err)
+	}
+	return mapping.Resources(a.Service, method), nil
+}
+
+// ClaimsAuthorizer reads the resources from a claim of the JWT itself. The claim is either an
+// auth/mapping style object of resources to permissions, or a list of resources that grants
+// every method. The token signature is not checked here.
+type ClaimsAuthorizer struct {
+	Claim   string
+	Service string
+}
+
+func (ca *ClaimsAuthorizer) Resources(token string, method string) ([]string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(BearerToken(token), claims); err != nil {
+		return nil, fmt.Errorf("parsing token: %s", err)
+	}
+	value, ok := claims[ca.Claim]
+	if !ok {
+		return []string{}, nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{}
+	if err := json.Unmarshal(raw, &list); err == nil {
+		sort.Strings(list)
+		return list, nil
+	}
+	mapping := Mapping{}
+	if err := json.Unmarshal(raw, &mapping); err != nil {
+		return nil, fmt.Errorf("token claim '%s' must be a list of resources or a mapping of resources to permissions", ca.Claim)
+	}
+	return mapping.Resources(ca.Service, method), nil
+}
+
+// StaticAuthorizer grants a fixed list of resources to every token, for local development
+type StaticAuthorizer struct {
+	resources []string
+}
+
+// NewStatic parses a comma separated list of resources. An empty list grants all resources
+func NewStatic(resources string) *StaticAuthorizer {
+	sa := &StaticAuthorizer{resources: []string{}}
+	for _, r := range strings.Split(resources, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			sa.resources = append(sa.resources, r)
+		}
+	}
+	if len(sa.resources) == 0 {
+		sa.resources = []string{AllResources}
+	}
+	return sa
+}
+
+func (sa *StaticAuthorizer) Resources(token string, method string) ([]string, error) {
+	out := make([]string, len(sa.resources))
+	copy(out, sa.resources)
+	return out, nil
+}
+
+// Subject returns the sub claim of a bearer token, "" if the token is not a JWT or has none.
+// The token signature is not checked here.
+func Subject(token string) string {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(BearerToken(token), claims); err != nil {
+		return ""
+	}
+	sub, _ := claims.GetSubject()
+	return sub
+}
+
+// BearerToken strips the 'Bearer ' scheme from an Authorization header value
+func BearerToken(header string) string {
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return strings.TrimSpace(header)
+}
@@ -0,0 +1,113 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testMapping = `{
+	"/programs/ohsu/projects/a": [{"service": "peregrine", "method": "read"}],
+	"/programs/ohsu/projects/b": [{"service": "*", "method": "*"}],
+	"/programs/ohsu/projects/c": [{"service": "sheepdog", "method": "create"}]
+}`
+
+func Test_ArboristResources(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/mapping" || r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, testMapping)
+	}))
+	defer srv.Close()
+
+	a, err := New(map[string]string{"arborist_url": srv.URL + "/"}, "peregrine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.Resources("Bearer good", "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res) != "[/programs/ohsu/projects/a /programs/ohsu/projects/b]" {
+		t.Errorf("unexpected read resources %v", res)
+	}
+	a, _ = New(map[string]string{"arborist_url": srv.URL}, "")
+	if res, _ := a.Resources("Bearer good", "create"); fmt.Sprint(res) != "[/programs/ohsu/projects/b /programs/ohsu/projects/c]" {
+		t.Errorf("unexpected create resources %v", res)
+	}
+	if _, err := a.Resources("Bearer bad", "read"); err == nil {
+		t.Error("expected an error for a rejected token")
+	}
+}
+
+func Test_ClaimsResources(t *testing.T) {
+	sign := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + s
+	}
+	a, _ := New(map[string]string{"authz": "claims", "authz_service": "sheepdog"}, "")
+	mapping := map[string]any{
+		"/programs/ohsu/projects/a": []any{map[string]any{"service": "peregrine", "method": "read"}},
+		"/programs/ohsu/projects/c": []any{map[string]any{"service": "sheepdog", "method": "create"}},
+	}
+	if res, err := a.Resources(sign(jwt.MapClaims{"authz": mapping}), "create"); err != nil || fmt.Sprint(res) != "[/programs/ohsu/projects/c]" {
+		t.Errorf("unexpected mapping claim resources %v %v", res, err)
+	}
+	if res, err := a.Resources(sign(jwt.MapClaims{"authz": []any{"/programs/x"}}), "delete"); err != nil || fmt.Sprint(res) != "[/programs/x]" {
+		t.Errorf("unexpected list claim resources %v %v", res, err)
+	}
+	if res, err := a.Resources(sign(jwt.MapClaims{"sub": "1"}), "read"); err != nil || len(res) != 0 {
+		t.Errorf("expected no resources without the claim, got %v %v", res, err)
+	}
+	if _, err := a.Resources("Bearer not-a-jwt", "read"); err == nil {
+		t.Error("expected an error for a malformed token")
+	}
+}
+
+func Test_StaticResources(t *testing.T) {
+	a, _ := New(map[string]string{"authz": "static", "authz_resources": "/programs/a, /programs/b"}, "")
+	if res, _ := a.Resources("", "read"); fmt.Sprint(res) != "[/programs/a /programs/b]" {
+		t.Errorf("unexpected static resources %v", res)
+	}
+	a, _ = New(map[string]string{"authz": "static"}, "")
+	if res, _ := a.Resources("", "read"); !Covers(res, "/programs/anything") {
+		t.Errorf("allow-all resources %v do not cover everything", res)
+	}
+	if _, err := New(map[string]string{"authz": "ldap"}, ""); err == nil {
+		t.Error("expected an error for an unknown authz")
+	}
+}
+
+func Test_Covers(t *testing.T) {
+	resources := []string{"/programs/ohsu/", "/programs/other/projects/p"}
+	for resource, want := range map[string]bool{
+		"/programs/ohsu":               true,
+		"/programs/ohsu/projects/a":    true,
+		"/programs/ohsu2/projects/a":   false,
+		"/programs/other/projects/p":   true,
+		"/programs/other/projects/pp":  false,
+		"/programs/other/projects/p/x": true,
+	} {
+		if Covers(resources, resource) != want {
+			t.Errorf("Covers(%s): expected %v", resource, want)
+		}
+	}
+}
+
+func Test_Subject(t *testing.T) {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "42"}).SignedString([]byte("secret"))
+	if sub := Subject("Bearer " + token); sub != "42" {
+		t.Errorf("expected sub 42, got '%s'", sub)
+	}
+	if sub := Subject("Bearer garbage"); sub != "" {
+		t.Errorf("expected no sub for a malformed token, got '%s'", sub)
+	}
+}
@@ -0,0 +1,284 @@
+package authz
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksRefresh is how long keys fetched from a URL are used before they are fetched again
+	jwksRefresh = time.Hour
+	// jwksMinRefresh limits how often the JWKS is fetched, on an unknown key id or after a failed fetch
+	jwksMinRefresh = time.Minute
+)
+
+// signingMethods are the asymmetric algorithms accepted for tokens, symmetric ones can't be checked against a JWKS
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Verifier checks the signature and expiry of tokens against the keys of a JWKS,
+// read from a file or fetched from a fence style /.well-known/jwks URL
+type Verifier struct {
+	file   string
+	url    string
+	client *http.Client
+
+	// fetching is held for the duration of a fetch, so concurrent requests don't fetch again
+	fetching sync.Mutex
+
+	mu       sync.Mutex
+	keys     map[string]any
+	loaded   time.Time // last successful fetch
+	fetched  time.Time // last fetch, successful or not
+	fetchErr error     // error of the last fetch
+}
+
+// NewVerifier reads the jwks_file or jwks_url entry of the plugin config. It returns nil if
+// neither is set, in which case tokens are not verified
+func NewVerifier(config map[string]string) (*Verifier, error) {
+	v := &Verifier{
+		file:   config["jwks_file"],
+		url:    config["jwks_url"],
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if v.file == "" && v.url == "" {
+		return nil, nil
+	}
+	if v.file != "" && v.url != "" {
+		return nil, fmt.Errorf("only one of jwks_file and jwks_url can be set")
+	}
+	if v.file != "" {
+		if err := v.load(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Verify checks that the token, an Authorization header value, is signed by a key of the
+// JWKS and has not expired. A nil Verifier accepts every token
+func (v *Verifier) Verify(token string) error {
+	if v == nil {
+		return nil
+	}
+	_, err := jwt.Parse(BearerToken(token), v.key,
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return fmt.Errorf("token has expired")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid token: %s", err)
+	}
+	return nil
+}
+
+// key finds the verification key of a token by its kid header. Keys fetched from a URL are
+// refreshed periodically, and on an unknown kid to pick up rotated keys
+func (v *Verifier) key(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	if v.url != "" {
+		v.mu.Lock()
+		missing, stale := v.keys == nil, time.Since(v.loaded) > jwksRefresh
+		v.mu.Unlock()
+		// stale keys are still good while another request refreshes them
+		if missing || stale {
+			if err := v.refresh(missing); err != nil && missing {
+				return nil, err
+			}
+		}
+	}
+	if k, ok := v.lookup(kid); ok {
+		return k, nil
+	}
+	if v.url != "" {
+		if err := v.refresh(true); err != nil {
+			return nil, err
+		}
+		if k, ok := v.lookup(kid); ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no key '%s' in the JWKS", kid)
+}
+
+// lookup returns the key with the kid, or the only key if the token has no kid
+func (v *Verifier) lookup(kid string) (any, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// load reads the keys of a jwks_file
+func (v *Verifier) load() error {
+	data, err := os.ReadFile(v.file)
+	if err != nil {
+		return fmt.Errorf("loading JWKS: %s", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// refresh fetches the keys of a jwks_url, at most once per jwksMinRefresh whether or not the last
+// fetch succeeded, and returns the error of the last fetch. mu is not held during the fetch, so
+// requests with a known key aren't held up by it. If wait is false and another request is already
+// fetching, refresh returns without waiting for it
+func (v *Verifier) refresh(wait bool) error {
+	if wait {
+		v.fetching.Lock()
+	} else if !v.fetching.TryLock() {
+		return nil
+	}
+	defer v.fetching.Unlock()
+
+	v.mu.Lock()
+	fetched, lastErr := v.fetched, v.fetchErr
+	v.mu.Unlock()
+	if time.Since(fetched) < jwksMinRefresh {
+		return lastErr
+	}
+
+	data, err := v.fetch()
+	var keys map[string]any
+	if err != nil {
+		err = fmt.Errorf("loading JWKS: %s", err)
+	} else {
+		keys, err = parseJWKS(data)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetched, v.fetchErr = time.Now(), err
+	if err == nil {
+		v.keys, v.loaded = keys, v.fetched
+	}
+	return err
+}
+
+func (v *Verifier) fetch() ([]byte, error) {
+	resp, err := v.client.Get(v.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", v.url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JWKS, indexed by kid
+func parseJWKS(data []byte) (map[string]any, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %s", err)
+	}
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key any
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k)
+		case "EC":
+			key, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key '%s': %s", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func rsaKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+	}
+	x, err := decodeInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
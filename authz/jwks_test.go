@@ -0,0 +1,204 @@
+package authz
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+		"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func jwksJSON(t *testing.T, keys ...map[string]string) []byte {
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func signed(t *testing.T, method jwt.SigningMethod, kid string, key any, exp time.Time) string {
+	claims := jwt.MapClaims{"sub": "user"}
+	if !exp.IsZero() {
+		claims["exp"] = exp.Unix()
+	}
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + s
+}
+
+func Test_JWKSVerify(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecJWK := map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256",
+		"x": b64(ec.PublicKey.X.FillBytes(make([]byte, 32))), "y": b64(ec.PublicKey.Y.FillBytes(make([]byte, 32)))}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(t, rsaJWK("fence", &key.PublicKey), ecJWK), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(map[string]string{"jwks_file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := time.Now().Add(time.Hour)
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rsa", signed(t, jwt.SigningMethodRS256, "fence", key, hour), true},
+		{"ec", signed(t, jwt.SigningMethodES256, "ec", ec, hour), true},
+		{"forged", signed(t, jwt.SigningMethodRS256, "fence", other, hour), false},
+		{"expired", signed(t, jwt.SigningMethodRS256, "fence", key, time.Now().Add(-time.Hour)), false},
+		{"no exp", signed(t, jwt.SigningMethodRS256, "fence", key, time.Time{}), false},
+		{"unknown kid", signed(t, jwt.SigningMethodRS256, "other", key, hour), false},
+		{"hmac", signed(t, jwt.SigningMethodHS256, "fence", []byte("secret"), hour), false},
+		{"garbage", "Bearer not.a.token", false},
+	}
+	for _, c := range cases {
+		err := v.Verify(c.token)
+		if c.valid && err != nil {
+			t.Errorf("%s: expected token to verify, got %s", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected token to be rejected", c.name)
+		}
+	}
+	if err := v.Verify(cases[3].token); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected expiry error, got %v", err)
+	}
+}
+
+func Test_JWKSURL(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := atomic.Value{}
+	keys.Store(jwksJSON(t, rsaJWK("k1", &key.PublicKey)))
+	fetches := atomic.Int64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fetches.Add(1)
+		w.Write(keys.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier(map[string]string{"jwks_url": srv.URL + "/.well-known/jwks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 0 {
+		t.Errorf("expected the JWKS to be fetched on first use")
+	}
+	hour := time.Now().Add(time.Hour)
+	if err := v.Verify(signed(t, jwt.SigningMethodRS256, "k1", key, hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(signed(t, jwt.SigningMethodRS256, "k1", key, hour)); err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected a single fetch, got %d", fetches.Load())
+	}
+
+	// a rotated key is picked up once the minimum refresh interval has passed
+	keys.Store(jwksJSON(t, rsaJWK("k1", &key.PublicKey), rsaJWK("k2", &rotated.PublicKey)))
+	token := signed(t, jwt.SigningMethodRS256, "k2", rotated, hour)
+	if err := v.Verify(token); err == nil {
+		t.Errorf("expected unknown key to be rejected within the refresh interval")
+	}
+	v.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	if err := v.Verify(token); err != nil {
+		t.Errorf("expected rotated key to verify, got %s", err)
+	}
+}
+
+func Test_JWKSFetchBackoff(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	up := atomic.Bool{}
+	fetches := atomic.Int64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(jwksJSON(t, rsaJWK("k1", &key.PublicKey)))
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier(map[string]string{"jwks_url": srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signed(t, jwt.SigningMethodRS256, "k1", key, time.Now().Add(time.Hour))
+	for i := 0; i < 3; i++ {
+		if err := v.Verify(token); err == nil {
+			t.Errorf("expected tokens to be rejected while the JWKS can't be fetched")
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected a failed fetch not to be retried within the refresh interval, got %d fetches", fetches.Load())
+	}
+
+	up.Store(true)
+	v.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	if err := v.Verify(token); err != nil {
+		t.Errorf("expected token to verify once the JWKS is back, got %s", err)
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("expected a second fetch, got %d", fetches.Load())
+	}
+}
+
+func Test_JWKSConfig(t *testing.T) {
+	v, err := NewVerifier(map[string]string{})
+	if err != nil || v != nil {
+		t.Fatalf("expected no verifier without a JWKS, got %v %v", v, err)
+	}
+	if err := v.Verify("Bearer anything"); err != nil {
+		t.Errorf("nil verifier should accept tokens, got %s", err)
+	}
+	if _, err := NewVerifier(map[string]string{"jwks_file": "a", "jwks_url": "b"}); err == nil {
+		t.Errorf("expected error for both jwks_file and jwks_url")
+	}
+	if _, err := NewVerifier(map[string]string{"jwks_file": filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Errorf("expected error for a missing jwks_file")
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, []byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`), 0600)
+	if _, err := NewVerifier(map[string]string{"jwks_file": path}); err == nil {
+		t.Errorf("expected error for a JWKS without signing keys")
+	}
+}
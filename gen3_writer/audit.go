@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmeg/grip-endpoints/authz"
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/gripql"
+	"github.com/bmeg/grip/log"
+	"github.com/bmeg/grip/util"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditLabel       = "AuditEntry"
+	auditCountsKey   = "audit.counts"
+	auditJobKey      = "audit.job"
+	auditUserKey     = "audit.user"
+	requestIDHeader  = "X-Request-Id"
+	defaultAuditSize = 100
+	// maxAuditGraphs bounds the graphs GET audit looks for entries of
+	maxAuditGraphs = 10000
+)
+
+// AuditEntry records a single mutating call: who made it, on which graph, and what came of it.
+// User is only Verified if the token was accepted, for rejected calls it is the subject the token claims
+type AuditEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Verified   bool      `json:"verified"`
+	Graph      string    `json:"graph"`
+	Operation  string    `json:"operation"`
+	RequestID  string    `json:"request_id"`
+	JobID      string    `json:"job_id,omitempty"`
+	Written    int64     `json:"written"`
+	Rejected   int64     `json:"rejected"`
+	Status     int       `json:"status"`
+	Outcome    string    `json:"outcome"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// auditCounts are the element counts a handler reports for the audit entry of its request
+type auditCounts struct {
+	written  int64
+	rejected int64
+}
+
+// setAuditCounts records the number of elements written and rejected by a request
+func setAuditCounts(c *gin.Context, written int64, rejected int64) {
+	c.Set(auditCountsKey, auditCounts{written: written, rejected: rejected})
+}
+
+// AuditLog stores audit entries as vertices of a grip graph, by default 'audit'
+type AuditLog struct {
+	client gripql.Client
+	graph  string
+
+	mu    sync.Mutex
+	ready bool
+}
+
+func NewAuditLog(client gripql.Client, config map[string]string) *AuditLog {
+	return &AuditLog{client: client, graph: auditGraphName(config)}
+}
+
+// auditGraphName returns the audit_graph of the plugin config, 'audit' if it is not set
+func auditGraphName(config map[string]string) string {
+	if graph := config["audit_graph"]; graph != "" {
+		return graph
+	}
+	return "audit"
+}
+
+// ensureGraph creates the audit graph the first time an entry is recorded
+func (al *AuditLog) ensureGraph() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.ready {
+		return nil
+	}
+	graphs, err := al.client.ListGraphs()
+	if err != nil {
+		return err
+	}
+	for _, g := range graphs.GetGraphs() {
+		if g == al.graph {
+			al.ready = true
+			return nil
+		}
+	}
+	if err := al.client.AddGraph(al.graph); err != nil {
+		return err
+	}
+	al.ready = true
+	return nil
+}
+
+// Record stores an entry
+func (al *AuditLog) Record(entry AuditEntry) error {
+	if err := al.ensureGraph(); err != nil {
+		return err
+	}
+	v := &gripql.Vertex{Gid: entry.ID, Label: auditLabel}
+	v.SetDataMap(entry.dataMap())
+	return al.client.AddVertex(al.graph, v)
+}
+
+func (e AuditEntry) dataMap() map[string]any {
+	return map[string]any{
+		"time":        e.Time.UTC().Format(time.RFC3339Nano),
+		"timestamp":   float64(e.Time.UnixMilli()),
+		"user":        e.User,
+		"verified":    e.Verified,
+		"graph":       e.Graph,
+		"operation":   e.Operation,
+		"request_id":  e.RequestID,
+		"job_id":      e.JobID,
+		"written":     float64(e.Written),
+		"rejected":    float64(e.Rejected),
+		"status":      float64(e.Status),
+		"outcome":     e.Outcome,
+		"duration_ms": float64(e.DurationMs),
+	}
+}
+
+func auditEntryFromMap(gid string, data map[string]any) AuditEntry {
+	str := func(k string) string {
+		s, _ := data[k].(string)
+		return s
+	}
+	num := func(k string) int64 {
+		f, _ := data[k].(float64)
+		return int64(f)
+	}
+	t, _ := time.Parse(time.RFC3339Nano, str("time"))
+	return AuditEntry{
+		ID:         gid,
+		Time:       t,
+		User:       str("user"),
+		Verified:   data["verified"] == true,
+		Graph:      str("graph"),
+		Operation:  str("operation"),
+		RequestID:  str("request_id"),
+		JobID:      str("job_id"),
+		Written:    num("written"),
+		Rejected:   num("rejected"),
+		Status:     int(num("status")),
+		Outcome:    str("outcome"),
+		DurationMs: num("duration_ms"),
+	}
+}
+
+// AuditFilter selects audit entries. Empty fields match everything, but only the entries of Graphs are returned
+type AuditFilter struct {
+	Graph     string
+	Graphs    []string
+	User      string
+	Operation string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// parseAuditFilter reads the graph, user, operation, since, until (RFC3339) and limit query parameters
+func parseAuditFilter(request *http.Request) (AuditFilter, error) {
+	q := request.URL.Query()
+	f := AuditFilter{Graph: q.Get("graph"), User: q.Get("user"), Operation: q.Get("operation"), Limit: defaultAuditSize}
+	for key, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, &middleware.ServerError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s must be an RFC3339 time, got '%s'", key, v)}
+			}
+			*t = parsed
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, &middleware.ServerError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("limit must be a positive integer, got '%s'", v)}
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+// auditQuery selects the entries of a filter, most recent first. Only entries with a verified
+// user match a user filter
+func auditQuery(f AuditFilter) *gripql.Query {
+	q := gripql.V().HasLabel(auditLabel).Has(gripql.Within("graph", stringsToAny(f.Graphs)...))
+	if f.User != "" {
+		q = q.Has(gripql.And(gripql.Eq("user", f.User), gripql.Eq("verified", true)))
+	}
+	if f.Operation != "" {
+		q = q.Has(gripql.Eq("operation", f.Operation))
+	}
+	if !f.Since.IsZero() {
+		q = q.Has(gripql.Gte("timestamp", float64(f.Since.UnixMilli())))
+	}
+	if !f.Until.IsZero() {
+		q = q.Has(gripql.Lte("timestamp", float64(f.Until.UnixMilli())))
+	}
+	return q.Sort(&gripql.SortField{Field: "timestamp", Descending: true}).Limit(uint32(f.Limit))
+}
+
+func stringsToAny(l []string) []any {
+	out := make([]any, len(l))
+	for i, s := range l {
+		out[i] = s
+	}
+	return out
+}
+
+// Query returns the matching entries of the filter's graphs, most recent first
+func (al *AuditLog) Query(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	out := []AuditEntry{}
+	if len(f.Graphs) == 0 {
+		return out, nil
+	}
+	res, err := al.client.Traversal(ctx, &gripql.GraphQuery{Graph: al.graph, Query: auditQuery(f).Statements})
+	if err != nil {
+		return nil, err
+	}
+	for r := range res {
+		if v := r.GetVertex(); v != nil {
+			out = append(out, auditEntryFromMap(v.Gid, v.GetDataMap()))
+		}
+	}
+	return out, nil
+}
+
+// Graphs returns the graphs the log has entries for, including graphs that have since been deleted
+func (al *AuditLog) Graphs(ctx context.Context) ([]string, error) {
+	q := gripql.V().HasLabel(auditLabel).Aggregate([]*gripql.Aggregate{{
+		Name:        "graph",
+		Aggregation: &gripql.Aggregate_Term{Term: &gripql.TermAggregation{Field: "graph", Size: maxAuditGraphs}},
+	}})
+	res, err := al.client.Traversal(ctx, &gripql.GraphQuery{Graph: al.graph, Query: q.Statements})
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for r := range res {
+		if agg := r.GetAggregations(); agg != nil {
+			if g := agg.GetKey().GetStringValue(); g != "" {
+				out = append(out, g)
+			}
+		}
+	}
+	return out, nil
+}
+
+// auditOperation names the operation of a route from its path, e.g. '/:graph/del-vertex/:vertex-id' is 'del-vertex'
+func auditOperation(c *gin.Context) string {
+	parts := []string{}
+	for _, p := range strings.Split(c.FullPath(), "/") {
+		if p != "" && !strings.HasPrefix(p, ":") {
+			parts = append(parts, p)
+		}
+	}
+	op := strings.Join(parts, "/")
+	if op == "jobs" && c.Request.Method == http.MethodDelete {
+		return "cancel-job"
+	}
+	return op
+}
+
+func auditOutcome(status int, rejected int64) string {
+	switch {
+	case status >= 400:
+		return "failure"
+	case rejected > 0 || status == http.StatusMultiStatus:
+		return "partial"
+	}
+	return "success"
+}
+
+// AuditMiddleware records an audit entry for every mutating request. Entries of async
+// loads are recorded once their job finishes, with the job's final counts and outcome
+func AuditMiddleware(al *AuditLog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" {
+			requestID = util.UUID()
+		}
+		c.Header(requestIDHeader, requestID)
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		entry := AuditEntry{
+			ID:        util.UUID(),
+			Time:      start,
+			User:      authz.Subject(c.GetHeader("Authorization")),
+			Graph:     c.Param("graph"),
+			Operation: auditOperation(c),
+			RequestID: requestID,
+			Status:    c.Writer.Status(),
+		}
+		if user, ok := c.Get(auditUserKey); ok {
+			entry.User, entry.Verified = user.(string), true
+		}
+		if v, ok := c.Get(auditCountsKey); ok {
+			counts := v.(auditCounts)
+			entry.Written, entry.Rejected = counts.written, counts.rejected
+		}
+		record := func(entry AuditEntry) {
+			entry.Outcome = auditOutcome(entry.Status, entry.Rejected)
+			if err := al.Record(entry); err != nil {
+				log.WithFields(log.Fields{"graph": entry.Graph, "request_id": entry.RequestID, "error": err}).Error("failed to record audit entry")
+			}
+		}
+		if v, ok := c.Get(auditJobKey); ok {
+			job := v.(*Job)
+			go func() {
+				<-job.Done()
+				summary := job.Report.Summary()
+				entry.JobID = job.ID
+				entry.Written, entry.Rejected = summary.Loaded, summary.Rejected
+				entry.Status = job.Report.StatusCode()
+				entry.DurationMs = time.Since(start).Milliseconds()
+				record(entry)
+			}()
+			return
+		}
+		entry.DurationMs = time.Since(start).Milliseconds()
+		record(entry)
+	}
+}
+
+// GetAudit lists the audit entries of the graphs the caller can read. Entries without a graph
+// belong to no one's graphs and are not listed
+func (gh *Handler) GetAudit(c *gin.Context, writer http.ResponseWriter, request *http.Request) {
+	filter, err := parseAuditFilter(request)
+	if err != nil {
+		RegError(c, writer, "", err)
+		return
+	}
+	graphs, err := gh.audit.Graphs(request.Context())
+	if err != nil {
+		RegError(c, writer, "", err)
+		return
+	}
+	resourceList := requestResources(c)
+	for _, g := range graphs {
+		if (filter.Graph == "" || g == filter.Graph) && len(gh.resources.Missing(g, resourceList)) == 0 {
+			filter.Graphs = append(filter.Graphs, g)
+		}
+	}
+	entries, err := gh.audit.Query(request.Context(), filter)
+	if err != nil {
+		RegError(c, writer, "", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "GET audit successful",
+		"data":    entries,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/gin-gonic/gin"
+)
+
+func Test_AuditOperation(t *testing.T) {
+	r := gin.New()
+	ops := map[string]string{}
+	record := func(c *gin.Context) { ops[c.Request.Method+" "+c.Request.URL.Path] = auditOperation(c) }
+	r.POST(":graph/add-vertex", record)
+	r.DELETE(":graph/del-vertex/:vertex-id", record)
+	r.DELETE(":graph/jobs/:job-id", record)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/test/add-vertex", nil),
+		httptest.NewRequest(http.MethodDelete, "/test/del-vertex/v1", nil),
+		httptest.NewRequest(http.MethodDelete, "/test/jobs/j1", nil),
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	expected := map[string]string{
+		"POST /test/add-vertex":      "add-vertex",
+		"DELETE /test/del-vertex/v1": "del-vertex",
+		"DELETE /test/jobs/j1":       "cancel-job",
+	}
+	for k, v := range expected {
+		if ops[k] != v {
+			t.Errorf("%s: expected operation %s, got %s", k, v, ops[k])
+		}
+	}
+}
+
+func Test_AuditOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		rejected int64
+		outcome  string
+	}{
+		{http.StatusOK, 0, "success"},
+		{http.StatusOK, 3, "partial"},
+		{http.StatusMultiStatus, 0, "partial"},
+		{http.StatusForbidden, 0, "failure"},
+		{http.StatusUnprocessableEntity, 10, "failure"},
+	} {
+		if o := auditOutcome(tc.status, tc.rejected); o != tc.outcome {
+			t.Errorf("%d/%d: expected %s, got %s", tc.status, tc.rejected, tc.outcome, o)
+		}
+	}
+}
+
+func Test_AuditEntryMap(t *testing.T) {
+	e := AuditEntry{
+		ID: "a1", Time: time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC), User: "42", Verified: true, Graph: "test",
+		Operation: "bulk-load", RequestID: "r1", JobID: "j1", Written: 10, Rejected: 2,
+		Status: 200, Outcome: "partial", DurationMs: 1500,
+	}
+	if out := auditEntryFromMap("a1", e.dataMap()); out != e {
+		t.Errorf("entry did not round trip: %+v", out)
+	}
+}
+
+func Test_AuditFilter(t *testing.T) {
+	f, err := parseAuditFilter(httptest.NewRequest(http.MethodGet, "/audit?graph=test&user=42&since=2024-07-01T00:00:00Z&limit=5", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Graph != "test" || f.User != "42" || f.Limit != 5 || f.Since.IsZero() || !f.Until.IsZero() {
+		t.Errorf("unexpected filter %+v", f)
+	}
+	for _, q := range []string{"since=yesterday", "limit=0"} {
+		if _, err := parseAuditFilter(httptest.NewRequest(http.MethodGet, "/audit?"+q, nil)); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
+
+func Test_AuditQuery(t *testing.T) {
+	since := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	latest := &gripql.SortField{Field: "timestamp", Descending: true}
+	cases := []struct {
+		name   string
+		filter AuditFilter
+		want   *gripql.Query
+	}{
+		{
+			"graphs", AuditFilter{Graphs: []string{"a", "b"}, Limit: 10},
+			gripql.V().HasLabel(auditLabel).Has(gripql.Within("graph", "a", "b")).Sort(latest).Limit(10),
+		},
+		{
+			"user and time", AuditFilter{Graphs: []string{"a"}, User: "42", Since: since, Limit: 5},
+			gripql.V().HasLabel(auditLabel).Has(gripql.Within("graph", "a")).
+				Has(gripql.And(gripql.Eq("user", "42"), gripql.Eq("verified", true))).
+				Has(gripql.Gte("timestamp", float64(since.UnixMilli()))).Sort(latest).Limit(5),
+		},
+	}
+	for _, c := range cases {
+		if got := auditQuery(c.filter); !reflect.DeepEqual(got.Statements, c.want.Statements) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want.Statements, got.Statements)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bmeg/grip-endpoints/authz"
+	"github.com/bmeg/grip/gripql"
+	"github.com/bmeg/grip/log"
+	"github.com/gin-gonic/gin"
+)
+
+// graphResourcePrefix is the plugin config key prefix that maps a graph to the Arborist
+// resources guarding it, e.g. 'resource.test: /programs/ohsu/projects/test,/programs/ohsu/projects/other'
+const graphResourcePrefix = "resource."
+
+// graphProgramKey is the plugin config key naming the program of the graphs without a
+// 'resource.<graph>' entry, e.g. 'resource_program: ohsu' guards graph test by /programs/ohsu/projects/test
+const graphProgramKey = "resource_program"
+
+// methodPermissionPrefix is the plugin config key prefix that overrides the Arborist
+// permission required for an HTTP method, e.g. 'permission.DELETE: delete'
+const methodPermissionPrefix = "permission."
+
+// defaultPermissions is the Arborist permission required for each HTTP method
+var defaultPermissions = map[string]string{
+	http.MethodGet:    "read",
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "update",
+	http.MethodDelete: "delete",
+}
+
+// MethodPermissions maps HTTP methods to the Arborist permission checked for them
+type MethodPermissions map[string]string
+
+// NewMethodPermissions applies the 'permission.<METHOD>' entries of the plugin config to the defaults
+func NewMethodPermissions(config map[string]string) MethodPermissions {
+	mp := MethodPermissions{}
+	for k, v := range defaultPermissions {
+		mp[k] = v
+	}
+	for k, v := range config {
+		if strings.HasPrefix(k, methodPermissionPrefix) {
+			mp[strings.ToUpper(strings.TrimPrefix(k, methodPermissionPrefix))] = v
+		}
+	}
+	return mp
+}
+
+// Permission returns the permission required for an HTTP method, false if the method is not allowed
+func (mp MethodPermissions) Permission(httpMethod string) (string, bool) {
+	p, ok := mp[httpMethod]
+	return p, ok && p != ""
+}
+
+// resourcesKey is the gin context key of the resources the caller holds for the request method
+const resourcesKey = "authz.resources"
+
+// resourcePathField is the data field holding the Arborist resource an element belongs to
+const resourcePathField = "auth_resource_path"
+
+// publicRoutes are the routes that only need a valid token, not access to a graph
+var publicRoutes = map[string]bool{
+	"/list-graphs": true,
+}
+
+// GraphResources maps each graph to the Arborist resource paths a user must hold to access it.
+// Graphs without a mapping follow the gen3 convention of a graph per project, and are guarded
+// by '/programs/<resource_program>/projects/<graph>'. Without a resource_program they are not accessible.
+type GraphResources struct {
+	graphs  map[string][]string
+	program string
+	// reserved is the audit graph, which no user can reach through the graph routes
+	reserved string
+}
+
+// NewGraphResources reads the 'resource.<graph>' and resource_program entries of the plugin config
+func NewGraphResources(config map[string]string) *GraphResources {
+	gr := &GraphResources{
+		graphs:   map[string][]string{},
+		program:  strings.TrimSpace(config[graphProgramKey]),
+		reserved: auditGraphName(config),
+	}
+	for k, v := range config {
+		if !strings.HasPrefix(k, graphResourcePrefix) {
+			continue
+		}
+		graph := strings.TrimPrefix(k, graphResourcePrefix)
+		for _, r := range strings.Split(v, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				gr.graphs[graph] = append(gr.graphs[graph], r)
+			}
+		}
+	}
+	return gr
+}
+
+// Required returns the resources guarding a graph, false if the graph has no mapping
+func (gr *GraphResources) Required(graph string) ([]string, bool) {
+	if required, ok := gr.graphs[graph]; ok {
+		return required, true
+	}
+	if gr.program != "" {
+		return []string{fmt.Sprintf("/programs/%s/projects/%s", gr.program, graph)}, true
+	}
+	return nil, false
+}
+
+// Missing returns the resources guarding a graph that are not covered by the user's
+// resources. A user resource covers itself and every resource below it. For a graph
+// without a mapping the missing 'resource.<graph>' config entry is returned, no user covers it
+func (gr *GraphResources) Missing(graph string, resourceList []string) []string {
+	required, ok := gr.Required(graph)
+	if !ok {
+		return []string{graphResourcePrefix + graph}
+	}
+	missing := []string{}
+	for _, req := range required {
+		if !authz.Covers(resourceList, req) {
+			missing = append(missing, req)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ParseAccess checks that the user's resources for a method cover the graph of the request.
+// On denial it responds with a 403 naming the missing resources and returns false. The audit
+// graph is never reachable through the graph routes, whatever the user's resources
+func ParseAccess(c *gin.Context, resources *GraphResources, resourceList []string, method string) bool {
+	graph := c.Param("graph")
+	if graph != "" && graph == resources.reserved {
+		log.WithFields(log.Fields{"graph": graph, "method": method}).Info("access to the audit graph denied")
+		c.JSON(http.StatusForbidden, gin.H{
+			"status":  http.StatusForbidden,
+			"message": fmt.Sprintf("Graph %s holds the audit log and can only be read through GET audit", graph),
+			"data":    gin.H{"graph": graph, "method": method},
+		})
+		c.Abort()
+		return false
+	}
+	if publicRoutes[c.FullPath()] || graph == "" {
+		return true
+	}
+	missing := resources.Missing(graph, resourceList)
+	if len(missing) == 0 {
+		return true
+	}
+	message := fmt.Sprintf("User is not allowed to %s on graph %s, missing access to %s", method, graph, strings.Join(missing, ", "))
+	if _, ok := resources.Required(graph); !ok {
+		message = fmt.Sprintf("Graph %s is not mapped to any resource, set %s%s or %s in the plugin config", graph, graphResourcePrefix, graph, graphProgramKey)
+	}
+	log.WithFields(log.Fields{"graph": graph, "method": method, "missing": missing}).Info("access denied")
+	c.JSON(http.StatusForbidden, gin.H{
+		"status":  http.StatusForbidden,
+		"message": message,
+		"data": gin.H{
+			"graph":   graph,
+			"method":  method,
+			"missing": missing,
+		},
+	})
+	c.Abort()
+	return false
+}
+
+// requestResources returns the resources the caller holds for the request method, as set by TokenAuthMiddleware
+func requestResources(c *gin.Context) []string {
+	if v, ok := c.Get(resourcesKey); ok {
+		if resources, ok := v.([]string); ok {
+			return resources
+		}
+	}
+	return []string{}
+}
+
+// AccessError rejects an element whose auth_resource_path the caller has no access to
+type AccessError struct {
+	Gid      string
+	Resource string
+}
+
+func (ae *AccessError) Error() string {
+	if ae.Resource == "" {
+		return fmt.Sprintf("%s has no %s", ae.Gid, resourcePathField)
+	}
+	return fmt.Sprintf("not allowed to write %s with %s %s", ae.Gid, resourcePathField, ae.Resource)
+}
+
+// checkResource checks the auth_resource_path of an element's data against the caller's resources.
+// Vertices must carry one, edges are only checked when they do
+func checkResource(resources []string, gid string, data map[string]any, required bool) error {
+	path, _ := data[resourcePathField].(string)
+	if path == "" {
+		if required {
+			return &AccessError{Gid: gid}
+		}
+		return nil
+	}
+	if !authz.Covers(resources, path) {
+		return &AccessError{Gid: gid, Resource: path}
+	}
+	return nil
+}
+
+// resourceCheck returns an elementCheck enforcing the caller's access to each element's auth_resource_path
+func resourceCheck(resources []string) elementCheck {
+	return func(ge *gripql.GraphElement) error {
+		if ge.Vertex != nil {
+			return checkResource(resources, ge.Vertex.Gid, ge.Vertex.GetDataMap(), true)
+		}
+		if ge.Edge != nil {
+			return checkResource(resources, ge.Edge.Gid, ge.Edge.GetDataMap(), false)
+		}
+		return nil
+	}
+}
+
+// storedElements are the versions already in the graph of the elements being written, and
+// the vertices their edges connect
+type storedElements struct {
+	vertices map[string]*gripql.Vertex
+	edges    map[string]*gripql.Edge
+}
+
+// fetchStored looks up the stored versions of elements and the vertices connected by the
+// new and the stored edges, a traversal per gidLookupBatch gids
+func fetchStored(ctx context.Context, client gripql.Client, graph string, elements []*gripql.GraphElement) (*storedElements, error) {
+	vertexIds, edgeIds := []string{}, []string{}
+	for _, ge := range elements {
+		if ge.Vertex != nil {
+			vertexIds = append(vertexIds, ge.Vertex.Gid)
+		}
+		if ge.Edge != nil {
+			edgeIds = append(edgeIds, ge.Edge.Gid)
+			vertexIds = append(vertexIds, ge.Edge.From, ge.Edge.To)
+		}
+	}
+	edges, err := fetchEdges(ctx, client, graph, edgeIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range edges {
+		vertexIds = append(vertexIds, e.From, e.To)
+	}
+	vertices, err := fetchVertices(ctx, client, graph, vertexIds)
+	if err != nil {
+		return nil, err
+	}
+	return &storedElements{vertices: vertices, edges: edges}, nil
+}
+
+// edgeResources checks the caller's access to an edge by its own auth_resource_path or, if
+// it has none, by those of the stored vertices it connects
+func (se *storedElements) edgeResources(resources []string, e *gripql.Edge) error {
+	if _, ok := e.GetDataMap()[resourcePathField]; ok {
+		return checkResource(resources, e.Gid, e.GetDataMap(), true)
+	}
+	for _, id := range []string{e.From, e.To} {
+		if v, ok := se.vertices[id]; ok {
+			if err := checkResource(resources, v.Gid, v.GetDataMap(), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkOwnership checks an element against what is stored: an element that replaces a stored one
+// needs access to the stored auth_resource_path too, so a gid can't be taken over by restamping it
+// with the caller's own path, and an edge without a path needs access to the vertices it connects.
+// The element's own auth_resource_path is checked by resourceCheck
+func checkOwnership(resources []string, ge *gripql.GraphElement, stored *storedElements) error {
+	if v := ge.Vertex; v != nil {
+		if old, ok := stored.vertices[v.Gid]; ok {
+			return checkResource(resources, old.Gid, old.GetDataMap(), true)
+		}
+		return nil
+	}
+	if e := ge.Edge; e != nil {
+		if old, ok := stored.edges[e.Gid]; ok {
+			if err := stored.edgeResources(resources, old); err != nil {
+				return err
+			}
+		}
+		if _, ok := e.GetDataMap()[resourcePathField]; !ok {
+			return stored.edgeResources(resources, e)
+		}
+	}
+	return nil
+}
+
+// ownedElements checks the elements of a load with checkOwnership, looking up the stored elements
+// of gidLookupBatch elements at a time. Elements the caller may write are passed on, the others are rejected
+func ownedElements(client gripql.Client, graph string, resources []string, in chan elementLine, report *LoadReport) chan elementLine {
+	out := make(chan elementLine, gidLookupBatch)
+	go func() {
+		defer close(out)
+		batch := []elementLine{}
+		flush := func() {
+			defer func() { batch = batch[:0] }()
+			if len(batch) == 0 || report.IsAborted() {
+				return
+			}
+			elements := make([]*gripql.GraphElement, len(batch))
+			for i, e := range batch {
+				elements[i] = e.elem
+			}
+			stored, err := fetchStored(context.Background(), client, graph, elements)
+			if err != nil {
+				report.Fail(fmt.Errorf("looking up stored elements near line %d: %s", batch[0].line, err))
+				return
+			}
+			for _, e := range batch {
+				if err := checkOwnership(resources, e.elem, stored); err != nil {
+					report.Reject(e.line, elementGid(e.elem), err)
+					continue
+				}
+				select {
+				case out <- e:
+				case <-report.Done():
+					return
+				}
+			}
+		}
+		for e := range in {
+			// keep draining after an abort so the upstream workers can exit
+			if report.IsAborted() {
+				continue
+			}
+			batch = append(batch, e)
+			if len(batch) == gidLookupBatch {
+				flush()
+			}
+		}
+		flush()
+	}()
+	return out
+}
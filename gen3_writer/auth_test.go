@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmeg/grip-endpoints/authz"
+	"github.com/bmeg/grip/gripql"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func Test_GraphResourcesMissing(t *testing.T) {
+	mapped := NewGraphResources(map[string]string{
+		"resource.shared": "/programs/ohsu/projects/a, /programs/ohsu/projects/b",
+		"validate_schema": "true",
+	})
+	program := NewGraphResources(map[string]string{"resource_program": "ohsu"})
+	cases := []struct {
+		gr        *GraphResources
+		graph     string
+		resources []string
+		missing   string
+	}{
+		{mapped, "shared", []string{"/programs/ohsu/projects/a", "/programs/ohsu/projects/b"}, "[]"},
+		{mapped, "shared", []string{"/programs/ohsu/projects/a"}, "[/programs/ohsu/projects/b]"},
+		{mapped, "shared", []string{"/programs/ohsu"}, "[]"},
+		{mapped, "shared", []string{"/programs/ohsu/projects/ab"}, "[/programs/ohsu/projects/a /programs/ohsu/projects/b]"},
+		// unmapped graphs are denied, whatever project names the user holds
+		{mapped, "test", []string{"/programs/ohsu/projects/test"}, "[resource.test]"},
+		{mapped, "test", []string{"/programs"}, "[resource.test]"},
+		// with a resource_program they are the project of the same name in that program only
+		{program, "test", []string{"/programs/ohsu/projects/test"}, "[]"},
+		{program, "test", []string{"/programs/other/projects/test"}, "[/programs/ohsu/projects/test]"},
+	}
+	for _, tc := range cases {
+		if missing := fmt.Sprint(tc.gr.Missing(tc.graph, tc.resources)); missing != tc.missing {
+			t.Errorf("%s %v: expected missing %s, got %s", tc.graph, tc.resources, tc.missing, missing)
+		}
+	}
+}
+
+func Test_ParseAccessRoutes(t *testing.T) {
+	gr := NewGraphResources(map[string]string{"resource_program": "ohsu"})
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if !ParseAccess(c, gr, []string{"/programs/ohsu/projects/test"}, "create") {
+			return
+		}
+		c.Next()
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("list-graphs", ok)
+	r.POST(":graph/add-vertex", ok)
+
+	for path, code := range map[string]int{
+		"/list-graphs":      http.StatusOK,
+		"/test/add-vertex":  http.StatusOK,
+		"/other/add-vertex": http.StatusForbidden,
+	} {
+		method := http.MethodPost
+		if path == "/list-graphs" {
+			method = http.MethodGet
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+}
+
+func Test_AuditGraphReserved(t *testing.T) {
+	config := map[string]string{"authz": "static", "resource_program": "ohsu"}
+	authorizer, err := authz.New(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every resource is granted, the handlers are never reached
+	r := gin.New()
+	r.Use(TokenAuthMiddleware(nil, authorizer, NewGraphResources(config), NewMethodPermissions(config)))
+	(&Handler{}).addRoutes(r)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodDelete, "/audit/del-graph", nil),
+		httptest.NewRequest(http.MethodPost, "/audit/add-vertex", strings.NewReader(`{"gid": "a1", "label": "AuditEntry"}`)),
+		httptest.NewRequest(http.MethodPost, "/audit/bulk-load", nil),
+		httptest.NewRequest(http.MethodGet, "/audit/get-vertex/a1", nil),
+	} {
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403, got %d", req.Method, req.URL.Path, w.Code)
+		}
+	}
+
+	gr := NewGraphResources(map[string]string{"audit_graph": "compliance", "resource_program": "ohsu"})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Params = gin.Params{{Key: "graph", Value: "compliance"}}
+	if ParseAccess(c, gr, []string{authz.AllResources}, "delete") {
+		t.Errorf("expected the configured audit graph to be reserved")
+	}
+}
+
+// recordingAuthorizer records the permission it is asked for and grants nothing, so requests
+// stop in TokenAuthMiddleware before reaching the handlers
+type recordingAuthorizer struct {
+	methods []string
+}
+
+func (ra *recordingAuthorizer) Resources(token string, method string) ([]string, error) {
+	ra.methods = append(ra.methods, method)
+	return []string{}, nil
+}
+
+func Test_RoutePermissions(t *testing.T) {
+	expected := map[string]string{
+		"POST /:graph/add-vertex":              "create",
+		"POST /:graph/add-edge":                "create",
+		"POST /:graph/add-vertices":            "create",
+		"POST /:graph/add-edges":               "create",
+		"POST /:graph/add-graph":               "create",
+		"POST /:graph/mongo-load":              "create",
+		"POST /:graph/bulk-load":               "create",
+		"POST /:graph/add-schema":              "create",
+		"POST /:graph/add-dictionary":          "create",
+		"DELETE /:graph/del-dictionary":        "delete",
+		"DELETE /:graph/del-graph":             "delete",
+		"DELETE /:graph/del-edge/:edge-id":     "delete",
+		"DELETE /:graph/del-vertex/:vertex-id": "delete",
+		"DELETE /:graph/jobs/:job-id":          "delete",
+		"GET /:graph/list-labels":              "read",
+		"GET /:graph/get-schema":               "read",
+		"GET /:graph/get-dictionary":           "read",
+		"GET /:graph/get-graph":                "read",
+		"GET /:graph/jobs":                     "read",
+		"GET /:graph/jobs/:job-id":             "read",
+		"GET /:graph/get-vertex/:vertex-id":    "read",
+		"GET /list-graphs":                     "read",
+		"GET /audit":                           "read",
+	}
+	authorizer := &recordingAuthorizer{}
+	r := gin.New()
+	r.Use(TokenAuthMiddleware(nil, authorizer, NewGraphResources(map[string]string{}), NewMethodPermissions(map[string]string{})))
+	(&Handler{}).addRoutes(r)
+
+	routes := r.Routes()
+	if len(routes) != len(expected) {
+		t.Errorf("expected %d routes, got %d", len(expected), len(routes))
+	}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		want, ok := expected[key]
+		if !ok {
+			t.Errorf("route %s has no expected permission", key)
+			continue
+		}
+		path := strings.NewReplacer(":graph", "test", ":edge-id", "e1", ":vertex-id", "v1", ":job-id", "j1").Replace(route.Path)
+		req := httptest.NewRequest(route.Method, path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		authorizer.methods = nil
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		if len(authorizer.methods) != 1 || authorizer.methods[0] != want {
+			t.Errorf("route %s: expected the authorizer to be asked for %s, got %v", key, want, authorizer.methods)
+		}
+	}
+}
+
+func Test_MethodPermissionsConfig(t *testing.T) {
+	mp := NewMethodPermissions(map[string]string{"permission.delete": "admin", "permission.PATCH": ""})
+	if p, _ := mp.Permission(http.MethodDelete); p != "admin" {
+		t.Errorf("expected configured delete permission, got %s", p)
+	}
+	if _, ok := mp.Permission(http.MethodPatch); ok {
+		t.Error("PATCH should be disabled by an empty permission")
+	}
+	if _, ok := mp.Permission(http.MethodOptions); ok {
+		t.Error("OPTIONS has no permission and should not be allowed")
+	}
+}
+
+func Test_ResourceCheck(t *testing.T) {
+	resources := []string{"/programs/ohsu/projects/a"}
+	cases := []struct {
+		data     map[string]any
+		required bool
+		allowed  bool
+	}{
+		{map[string]any{"auth_resource_path": "/programs/ohsu/projects/a"}, true, true},
+		{map[string]any{"auth_resource_path": "/programs/ohsu/projects/b"}, true, false},
+		{map[string]any{"auth_resource_path": "/programs/ohsu/projects/b"}, false, false},
+		{map[string]any{}, true, false},
+		{map[string]any{}, false, true},
+	}
+	for _, tc := range cases {
+		err := checkResource(resources, "gid", tc.data, tc.required)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%v required=%v: expected allowed=%v, got %v", tc.data, tc.required, tc.allowed, err)
+		}
+		if err != nil {
+			if _, ok := err.(*AccessError); !ok {
+				t.Errorf("expected an AccessError, got %T", err)
+			}
+		}
+	}
+}
+
+func Test_Ownership(t *testing.T) {
+	resources := []string{"/programs/ohsu/projects/a"}
+	vertex := func(gid string, path string) *gripql.Vertex {
+		v := &gripql.Vertex{Gid: gid, Label: "Patient"}
+		v.SetDataMap(map[string]any{"auth_resource_path": path})
+		return v
+	}
+	edge := func(gid string, from string, to string, path string) *gripql.Edge {
+		e := &gripql.Edge{Gid: gid, Label: "subject", From: from, To: to}
+		if path != "" {
+			e.SetDataMap(map[string]any{"auth_resource_path": path})
+		}
+		return e
+	}
+	stored := &storedElements{
+		vertices: map[string]*gripql.Vertex{
+			"pa": vertex("pa", "/programs/ohsu/projects/a"),
+			"pb": vertex("pb", "/programs/ohsu/projects/b"),
+		},
+		edges: map[string]*gripql.Edge{
+			"ea":  edge("ea", "pa", "pa", ""),
+			"eb":  edge("eb", "pb", "pb", ""),
+			"ebp": edge("ebp", "pa", "pa", "/programs/ohsu/projects/b"),
+		},
+	}
+	cases := []struct {
+		name    string
+		elem    *gripql.GraphElement
+		allowed bool
+	}{
+		{"new vertex", &gripql.GraphElement{Vertex: vertex("new", "/programs/ohsu/projects/a")}, true},
+		{"own vertex", &gripql.GraphElement{Vertex: vertex("pa", "/programs/ohsu/projects/a")}, true},
+		{"restamped vertex of another project", &gripql.GraphElement{Vertex: vertex("pb", "/programs/ohsu/projects/a")}, false},
+		{"edge between own vertices", &gripql.GraphElement{Edge: edge("new", "pa", "pa", "")}, true},
+		{"edge to another project", &gripql.GraphElement{Edge: edge("new", "pa", "pb", "")}, false},
+		{"edge to a vertex not stored yet", &gripql.GraphElement{Edge: edge("new", "pa", "later", "")}, true},
+		{"edge with its own path", &gripql.GraphElement{Edge: edge("new", "pa", "pb", "/programs/ohsu/projects/a")}, true},
+		{"overwritten edge of another project", &gripql.GraphElement{Edge: edge("eb", "pa", "pa", "")}, false},
+		{"overwritten edge with another path", &gripql.GraphElement{Edge: edge("ebp", "pa", "pa", "/programs/ohsu/projects/a")}, false},
+		{"own edge", &gripql.GraphElement{Edge: edge("ea", "pa", "pa", "")}, true},
+	}
+	for _, tc := range cases {
+		err := checkOwnership(resources, tc.elem, stored)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", tc.name, tc.allowed, err)
+		}
+		if err != nil {
+			if _, ok := err.(*AccessError); !ok {
+				t.Errorf("%s: expected an AccessError, got %T", tc.name, err)
+			}
+		}
+	}
+}
+
+func Test_RequestResources(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if r := requestResources(c); len(r) != 0 {
+		t.Errorf("expected no resources without the middleware, got %v", r)
+	}
+	c.Set(resourcesKey, []string{"/programs/a"})
+	if r := requestResources(c); len(r) != 1 {
+		t.Errorf("expected the middleware resources, got %v", r)
+	}
+}
+
+// countingAuthorizer grants every resource and counts its lookups
+type countingAuthorizer struct {
+	calls int
+}
+
+func (ca *countingAuthorizer) Resources(token string, method string) ([]string, error) {
+	ca.calls++
+	return []string{authz.AllResources}, nil
+}
+
+func Test_TokenAuthVerify(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "fence", "n": "%s", "e": "%s"}]}`,
+		enc(key.N.Bytes()), enc(big.NewInt(int64(key.E)).Bytes()))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := authz.NewVerifier(map[string]string{"jwks_file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(k *rsa.PrivateKey, exp time.Time) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user", "exp": exp.Unix()})
+		tok.Header["kid"] = "fence"
+		s, _ := tok.SignedString(k)
+		return "Bearer " + s
+	}
+
+	authorizer := &countingAuthorizer{}
+	r := gin.New()
+	r.Use(TokenAuthMiddleware(verifier, authorizer, NewGraphResources(map[string]string{"resource_program": "ohsu"}), NewMethodPermissions(map[string]string{})))
+	var user any
+	record := func(c *gin.Context) {
+		user, _ = c.Get(auditUserKey)
+		c.Status(http.StatusOK)
+	}
+	r.POST(":graph/add-vertex", record)
+
+	hour := time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		name  string
+		token string
+		code  int
+		calls int
+	}{
+		{"forged", sign(forger, hour), http.StatusUnauthorized, 0},
+		{"expired", sign(key, time.Now().Add(-time.Hour)), http.StatusUnauthorized, 0},
+		{"valid", sign(key, hour), http.StatusOK, 1},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/test/add-vertex", nil)
+		req.Header.Set("Authorization", tc.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code || authorizer.calls != tc.calls {
+			t.Errorf("%s: expected %d with %d authorizer calls, got %d with %d", tc.name, tc.code, tc.calls, w.Code, authorizer.calls)
+		}
+	}
+	if user != "user" {
+		t.Errorf("expected the verified sub to be recorded for the audit log, got %v", user)
+	}
+
+	// without a JWKS the sub is only claimed, not verified
+	user = nil
+	r = gin.New()
+	r.Use(TokenAuthMiddleware(nil, authorizer, NewGraphResources(map[string]string{"resource_program": "ohsu"}), NewMethodPermissions(map[string]string{})))
+	r.POST(":graph/add-vertex", record)
+	req := httptest.NewRequest(http.MethodPost, "/test/add-vertex", nil)
+	req.Header.Set("Authorization", sign(key, hour))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if user != nil {
+		t.Errorf("expected no verified user without a verifier, got %v", user)
+	}
+}
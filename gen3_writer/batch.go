@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/gripql"
+	"github.com/bmeg/grip/log"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ElementResult is the outcome of writing a single element of a batch request
+type ElementResult struct {
+	Index      int         `json:"index"`
+	Gid        string      `json:"gid,omitempty"`
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+func okResult(i int, gid string) ElementResult {
+	return ElementResult{Index: i, Gid: gid, Status: "ok"}
+}
+
+func errResult(i int, gid string, err error) ElementResult {
+	if ae, ok := err.(*middleware.ServerError); ok {
+		return ElementResult{Index: i, Gid: gid, Status: "error", Error: ae.Message}
+	}
+	return ElementResult{Index: i, Gid: gid, Status: "error", Error: err.Error(), Violations: violations(err)}
+}
+
+// decodeBatch reads a JSON array from the request body and returns the raw elements
+func decodeBatch(request *http.Request) ([]json.RawMessage, error) {
+	var elements []json.RawMessage
+	if err := json.NewDecoder(request.Body).Decode(&elements); err != nil {
+		return nil, &middleware.ServerError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("request body must be a JSON array: %s", err)}
+	}
+	return elements, nil
+}
+
+// batchResponse writes the per-index results. A 207 is returned when some of the elements failed
+func batchResponse(c *gin.Context, graph string, kind string, results []ElementResult) {
+	failed := 0
+	for _, r := range results {
+		if r.Status != "ok" {
+			failed++
+		}
+	}
+	code := http.StatusOK
+	message := fmt.Sprintf("POST add-%s successful", kind)
+	if failed > 0 {
+		code = http.StatusMultiStatus
+		message = fmt.Sprintf("%d of %d %s failed to write", failed, len(results), kind)
+	}
+	log.WithFields(log.Fields{"graph": graph}).Infof("Wrote %d of %d %s", len(results)-failed, len(results), kind)
+	setAuditCounts(c, int64(len(results)-failed), int64(failed))
+	c.JSON(code, gin.H{
+		"status":  code,
+		"message": message,
+		"data": gin.H{
+			"written": len(results) - failed,
+			"failed":  failed,
+			"results": results,
+		},
+	})
+}
+
+// bulkWrite writes the checked elements of a batch with a single BulkAdd stream. BulkAdd
+// reports one error for the whole stream, so if it fails every element of it is marked failed
+func (gh *Handler) bulkWrite(graph string, indexes []int, elements []*gripql.GraphElement, results []ElementResult) {
+	if len(elements) == 0 {
+		return
+	}
+	elemChan := make(chan *gripql.GraphElement, len(elements))
+	for _, ge := range elements {
+		ge.Graph = graph
+		elemChan <- ge
+	}
+	close(elemChan)
+	err := gh.client.BulkAdd(elemChan)
+	for n, i := range indexes {
+		gid := elementGid(elements[n])
+		if err != nil {
+			results[i] = errResult(i, gid, fmt.Errorf("bulk write failed: %s", err))
+		} else {
+			results[i] = okResult(i, gid)
+		}
+	}
+}
+
+// checkBatch runs the checks on the parsed elements of a batch, and checkOwnership against
+// their stored versions, which are looked up together. It returns the elements to write and
+// their indexes, failed elements get an error result. A failure to look up elements is returned
+func (gh *Handler) checkBatch(c *gin.Context, graph string, checks []elementCheck, parsed []*gripql.GraphElement, results []ElementResult) ([]int, []*gripql.GraphElement, error) {
+	elements := []*gripql.GraphElement{}
+	for _, ge := range parsed {
+		if ge != nil {
+			elements = append(elements, ge)
+		}
+	}
+	stored, err := fetchStored(c.Request.Context(), gh.client, graph, elements)
+	if err != nil {
+		return nil, nil, err
+	}
+	resources := requestResources(c)
+	indexes, checked := []int{}, []*gripql.GraphElement{}
+	for i, ge := range parsed {
+		if ge == nil {
+			continue
+		}
+		gid := elementGid(ge)
+		if ge.Edge != nil {
+			if err := checkEdgeEndpoints(graph, ge.Edge, stored.vertices); err != nil {
+				results[i] = errResult(i, gid, err)
+				continue
+			}
+		}
+		err := runChecks(checks, ge)
+		if err == nil {
+			err = checkOwnership(resources, ge, stored)
+		}
+		if isLookupError(err) {
+			return nil, nil, err
+		} else if err != nil {
+			results[i] = errResult(i, gid, err)
+			continue
+		}
+		indexes, checked = append(indexes, i), append(checked, ge)
+	}
+	return indexes, checked, nil
+}
+
+func (gh *Handler) WriteVertices(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	elements, err := decodeBatch(request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	checks, err := gh.writeChecks(c, graph, request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	results := make([]ElementResult, len(elements))
+	parsed := make([]*gripql.GraphElement, len(elements))
+	for i, raw := range elements {
+		v := &gripql.Vertex{}
+		if err := protojson.Unmarshal(raw, v); err != nil {
+			results[i] = errResult(i, "", fmt.Errorf("failed to parse vertex: %s", err))
+			continue
+		}
+		parsed[i] = &gripql.GraphElement{Vertex: v}
+	}
+	indexes, checked, err := gh.checkBatch(c, graph, checks, parsed, results)
+	if err != nil {
+		log.WithFields(log.Fields{"graph": graph, "error": err}).Error("element check failed")
+		RegError(c, writer, graph, err)
+		return
+	}
+	gh.bulkWrite(graph, indexes, checked, results)
+	batchResponse(c, graph, "vertices", results)
+}
+
+func (gh *Handler) WriteEdges(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	elements, err := decodeBatch(request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	checks, err := gh.writeChecks(c, graph, request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	results := make([]ElementResult, len(elements))
+	parsed := make([]*gripql.GraphElement, len(elements))
+	for i, raw := range elements {
+		e := &gripql.Edge{}
+		if err := protojson.Unmarshal(raw, e); err != nil {
+			results[i] = errResult(i, "", fmt.Errorf("failed to parse edge: %s", err))
+			continue
+		}
+		parsed[i] = &gripql.GraphElement{Edge: e}
+	}
+	// the stored elements and endpoints of the whole batch are looked up together rather than per edge
+	indexes, checked, err := gh.checkBatch(c, graph, checks, parsed, results)
+	if err != nil {
+		log.WithFields(log.Fields{"graph": graph, "error": err}).Error("element check failed")
+		RegError(c, writer, graph, err)
+		return
+	}
+	gh.bulkWrite(graph, indexes, checked, results)
+	batchResponse(c, graph, "edges", results)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/gripql"
+)
+
+func Test_EdgeEndpoints(t *testing.T) {
+	vertices := map[string]*gripql.Vertex{"p1": {Gid: "p1"}, "o1": {Gid: "o1"}}
+	cases := []struct {
+		edge *gripql.Edge
+		code int
+	}{
+		{&gripql.Edge{Gid: "e1", From: "o1", To: "p1"}, 0},
+		{&gripql.Edge{Gid: "e2", From: "o1", To: "p2"}, 404},
+		{&gripql.Edge{Gid: "e3", From: "o1"}, 422},
+	}
+	for _, c := range cases {
+		err := checkEdgeEndpoints("test", c.edge, vertices)
+		if c.code == 0 {
+			if err != nil {
+				t.Errorf("%s: expected endpoints to be found, got %s", c.edge.Gid, err)
+			}
+			continue
+		}
+		se, ok := err.(*middleware.ServerError)
+		if !ok || se.StatusCode != c.code {
+			t.Errorf("%s: expected a %d, got %v", c.edge.Gid, c.code, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/gripql"
+	"github.com/bmeg/grip/log"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Violation is a single failed constraint of a record, located by a JSON pointer into its data
+type Violation struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// DictionaryError lists the dictionary violations of a vertex
+type DictionaryError struct {
+	Label      string
+	Violations []Violation
+}
+
+func (de *DictionaryError) Error() string {
+	msgs := make([]string, len(de.Violations))
+	for i, v := range de.Violations {
+		msgs[i] = fmt.Sprintf("%s: %s", v.Path, v.Error)
+	}
+	return fmt.Sprintf("%s does not conform to the data dictionary: %s", de.Label, strings.Join(msgs, "; "))
+}
+
+// violations returns the dictionary violations carried by an error, if any
+func violations(err error) []Violation {
+	de := &DictionaryError{}
+	if errors.As(err, &de) {
+		return de.Violations
+	}
+	return nil
+}
+
+// Dictionary is a compiled Gen3/iceberg data dictionary, a JSON object mapping node ids to
+// JSON Schema node definitions plus the shared '_definitions', '_terms' and '_settings' entries
+type Dictionary struct {
+	nodes map[string]*jsonschema.Schema
+}
+
+// CompileDictionary compiles every node definition of a dictionary. Each entry is registered
+// as '<graph>/<entry>.yaml' so the gen3 style references, such as '_definitions.yaml#/UUID', resolve
+func CompileDictionary(graph string, data []byte) (*Dictionary, error) {
+	entries := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("dictionary must be a JSON object of node definitions: %s", err)
+	}
+	c := jsonschema.NewCompiler()
+	// gen3 dictionaries are draft-04, where 'id' rather than '$id' sets the base URI
+	c.Draft = jsonschema.Draft4
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("reference %s is not part of the dictionary", s)
+	}
+	urls := map[string]string{}
+	for key, raw := range entries {
+		url := fmt.Sprintf("file:///%s/%s.yaml", graph, strings.TrimSuffix(key, ".yaml"))
+		if err := c.AddResource(url, bytes.NewReader(raw)); err != nil {
+			return nil, fmt.Errorf("dictionary entry %s: %s", key, err)
+		}
+		if !strings.HasPrefix(key, "_") {
+			urls[strings.ToLower(strings.TrimSuffix(key, ".yaml"))] = url
+		}
+	}
+	d := &Dictionary{nodes: map[string]*jsonschema.Schema{}}
+	for node, url := range urls {
+		sch, err := c.Compile(url)
+		if err != nil {
+			return nil, fmt.Errorf("dictionary node %s: %s", node, err)
+		}
+		d.nodes[node] = sch
+	}
+	if len(d.nodes) == 0 {
+		return nil, fmt.Errorf("dictionary has no node definitions")
+	}
+	return d, nil
+}
+
+// Nodes returns the sorted node ids of the dictionary
+func (d *Dictionary) Nodes() []string {
+	out := make([]string, 0, len(d.nodes))
+	for k := range d.nodes {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ValidateVertex validates the data of a vertex against the node definition for its label
+func (d *Dictionary) ValidateVertex(v *gripql.Vertex) error {
+	return d.Validate(v.Label, v.GetDataMap())
+}
+
+// Validate validates a record against the node definition for a label
+func (d *Dictionary) Validate(label string, data map[string]any) error {
+	sch, ok := d.nodes[strings.ToLower(label)]
+	if !ok {
+		return &DictionaryError{Label: label, Violations: []Violation{{Path: "/", Error: fmt.Sprintf("no node definition for label '%s' in the data dictionary", label)}}}
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	err := sch.Validate(data)
+	if err == nil {
+		return nil
+	}
+	ve := &jsonschema.ValidationError{}
+	if !errors.As(err, &ve) {
+		return err
+	}
+	de := &DictionaryError{Label: label}
+	collectViolations(ve, de)
+	return de
+}
+
+// collectViolations flattens a validation error into its leaf causes, the
+// intermediate errors only summarize that a subschema failed
+func collectViolations(ve *jsonschema.ValidationError, de *DictionaryError) {
+	if len(ve.Causes) == 0 {
+		path := ve.InstanceLocation
+		if path == "" {
+			path = "/"
+		}
+		de.Violations = append(de.Violations, Violation{Path: path, Error: ve.Message})
+		return
+	}
+	for _, c := range ve.Causes {
+		collectViolations(c, de)
+	}
+}
+
+// Check validates vertices. Edges have no node definition and always pass. It has the signature of an elementCheck
+func (d *Dictionary) Check(ge *gripql.GraphElement) error {
+	if ge.Vertex != nil {
+		return d.ValidateVertex(ge.Vertex)
+	}
+	return nil
+}
+
+// DictionaryRegistry holds the dictionary registered for each graph. If a directory is
+// configured the dictionaries are also saved there as '<graph>.json' and reloaded on demand
+type DictionaryRegistry struct {
+	mu    sync.Mutex
+	dir   string
+	dicts map[string]*Dictionary
+}
+
+func NewDictionaryRegistry(dir string) *DictionaryRegistry {
+	return &DictionaryRegistry{dir: dir, dicts: map[string]*Dictionary{}}
+}
+
+// Get returns the dictionary of a graph, or nil if none has been registered
+func (dr *DictionaryRegistry) Get(graph string) (*Dictionary, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if d, ok := dr.dicts[graph]; ok {
+		return d, nil
+	}
+	if dr.dir == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dr.dir, filepath.Base(graph)+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d, err := CompileDictionary(graph, data)
+	if err != nil {
+		return nil, err
+	}
+	dr.dicts[graph] = d
+	return d, nil
+}
+
+// Put compiles and registers the dictionary of a graph
+func (dr *DictionaryRegistry) Put(graph string, data []byte) (*Dictionary, error) {
+	d, err := CompileDictionary(graph, data)
+	if err != nil {
+		return nil, err
+	}
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if dr.dir != "" {
+		if err := os.WriteFile(filepath.Join(dr.dir, filepath.Base(graph)+".json"), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	dr.dicts[graph] = d
+	return d, nil
+}
+
+// Delete removes the dictionary of a graph
+func (dr *DictionaryRegistry) Delete(graph string) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	delete(dr.dicts, graph)
+	if dr.dir != "" {
+		err := os.Remove(filepath.Join(dr.dir, filepath.Base(graph)+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gh *Handler) AddDictionary(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	var data []byte
+	var err error
+	if file, _, ferr := request.FormFile("file"); ferr == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+	} else {
+		data, err = io.ReadAll(request.Body)
+	}
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	d, err := gh.dictionaries.Put(graph, data)
+	if err != nil {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("invalid dictionary: %s", err)})
+		return
+	}
+	log.WithFields(log.Fields{"graph": graph}).Infof("Registered data dictionary with %d nodes", len(d.nodes))
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "POST add-dictionary successful",
+		"data":    d.Nodes(),
+	})
+}
+
+func (gh *Handler) GetDictionary(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	d, err := gh.dictionaries.Get(graph)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	if d == nil {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("no data dictionary registered for graph %s", graph)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "GET get-dictionary successful",
+		"data":    d.Nodes(),
+	})
+}
+
+func (gh *Handler) DeleteDictionary(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	if err := gh.dictionaries.Delete(graph); err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "DELETE del-dictionary successful",
+		"data":    nil,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+var testDictionary = `{
+	"_definitions": {
+		"id": "_definitions",
+		"UUID": {"type": "string", "pattern": "^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$"}
+	},
+	"patient": {
+		"$schema": "http://json-schema.org/draft-04/schema#",
+		"id": "patient",
+		"type": "object",
+		"required": ["id", "gender"],
+		"properties": {
+			"id": {"$ref": "_definitions.yaml#/UUID"},
+			"gender": {"enum": ["male", "female", "other", "unknown"]},
+			"birthDate": {"type": "string"}
+		}
+	}
+}`
+
+func Test_DictionaryValidate(t *testing.T) {
+	d, err := CompileDictionary("test", []byte(testDictionary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Nodes()) != 1 || d.Nodes()[0] != "patient" {
+		t.Errorf("unexpected nodes %v", d.Nodes())
+	}
+
+	if err := d.Validate("Patient", map[string]any{"id": "fb60e763-e799-4d59-82a3-66977cc6696c", "gender": "female"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	err = d.Validate("Patient", map[string]any{"id": "not-a-uuid", "gender": "f"})
+	v := violations(err)
+	paths := map[string]bool{}
+	for _, i := range v {
+		paths[i.Path] = true
+	}
+	if !paths["/id"] || !paths["/gender"] {
+		t.Errorf("expected violations at /id and /gender, got %+v", v)
+	}
+
+	v = violations(d.Validate("Patient", map[string]any{"id": "fb60e763-e799-4d59-82a3-66977cc6696c"}))
+	if len(v) != 1 || v[0].Path != "/" {
+		t.Errorf("expected missing required property violation, got %+v", v)
+	}
+
+	if violations(d.Validate("Observation", map[string]any{})) == nil {
+		t.Error("expected violation for label without node definition")
+	}
+}
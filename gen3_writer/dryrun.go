@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/bmeg/grip/gripql"
+)
+
+// DryRunSummary is what a dry run load found: element counts per label and the
+// gids of the file that already exist in the graph
+type DryRunSummary struct {
+	Vertices     map[string]int64 `json:"vertices"`
+	Edges        map[string]int64 `json:"edges"`
+	Existing     int64            `json:"existing"`
+	ExistingGids []string         `json:"existing_gids"`
+}
+
+// dryRun takes the place of the grip or mongo writer when a load is run with dry_run.
+// Elements are counted per label and their gids are looked up in the graph in batches.
+type dryRun struct {
+	client gripql.Client
+	graph  string
+	report *LoadReport
+
+	mu       sync.Mutex
+	summary  DryRunSummary
+	vertices []string
+	edges    []string
+}
+
+func newDryRun(client gripql.Client, graph string, report *LoadReport) *dryRun {
+	return &dryRun{
+		client: client,
+		graph:  graph,
+		report: report,
+		summary: DryRunSummary{
+			Vertices:     map[string]int64{},
+			Edges:        map[string]int64{},
+			ExistingGids: []string{},
+		},
+	}
+}
+
+// AddVertex counts a vertex that would have been written
+func (dr *dryRun) AddVertex(gid string, label string) {
+	dr.mu.Lock()
+	dr.summary.Vertices[label]++
+	dr.vertices = append(dr.vertices, gid)
+	batch := dr.take(&dr.vertices, false)
+	dr.mu.Unlock()
+	dr.lookup(gripql.V, batch)
+	dr.report.AddLoaded(1)
+}
+
+// AddEdge counts an edge that would have been written
+func (dr *dryRun) AddEdge(gid string, label string) {
+	dr.mu.Lock()
+	dr.summary.Edges[label]++
+	dr.edges = append(dr.edges, gid)
+	batch := dr.take(&dr.edges, false)
+	dr.mu.Unlock()
+	dr.lookup(gripql.E, batch)
+	dr.report.AddLoaded(1)
+}
+
+// Finish looks up the remaining gids and returns the summary
+func (dr *dryRun) Finish() DryRunSummary {
+	dr.mu.Lock()
+	vertices := dr.take(&dr.vertices, true)
+	edges := dr.take(&dr.edges, true)
+	dr.mu.Unlock()
+	dr.lookup(gripql.V, vertices)
+	dr.lookup(gripql.E, edges)
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	sort.Strings(dr.summary.ExistingGids)
+	return dr.summary
+}
+
+// take removes a full batch of pending gids, or whatever is pending if all is set
+func (dr *dryRun) take(pending *[]string, all bool) []string {
+	if len(*pending) == 0 || (!all && len(*pending) < gidLookupBatch) {
+		return nil
+	}
+	batch := *pending
+	*pending = nil
+	return batch
+}
+
+// lookup records which of the gids are already in the graph
+func (dr *dryRun) lookup(start func(ids ...string) *gripql.Query, gids []string) {
+	if len(gids) == 0 || dr.report.IsAborted() {
+		return
+	}
+	found := []string{}
+	fields := func(ids ...string) *gripql.Query { return start(ids...).Fields() }
+	err := traverseGids(context.Background(), dr.client, dr.graph, fields, gids, func(r *gripql.QueryResult) {
+		if v := r.GetVertex(); v != nil {
+			found = append(found, v.Gid)
+		} else if e := r.GetEdge(); e != nil {
+			found = append(found, e.Gid)
+		}
+	})
+	if err != nil {
+		dr.report.Fail(err)
+		return
+	}
+	dr.mu.Lock()
+	dr.summary.Existing += int64(len(found))
+	for _, gid := range found {
+		if len(dr.summary.ExistingGids) < maxReportedRejects {
+			dr.summary.ExistingGids = append(dr.summary.ExistingGids, gid)
+		}
+	}
+	dr.mu.Unlock()
+}
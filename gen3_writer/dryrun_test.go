@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+)
+
+func Test_DryRunCounts(t *testing.T) {
+	report := NewLoadReport(0)
+	dry := newDryRun(gripql.Client{}, "test", report)
+	// elements without a gid are counted but never looked up
+	dry.AddVertex("", "Patient")
+	dry.AddVertex("", "Patient")
+	dry.AddVertex("", "Observation")
+	dry.AddEdge("", "subject_Patient")
+	summary := dry.Finish()
+	if summary.Vertices["Patient"] != 2 || summary.Vertices["Observation"] != 1 || summary.Edges["subject_Patient"] != 1 {
+		t.Errorf("unexpected label counts %+v", summary)
+	}
+	if report.Summary().Loaded != 4 {
+		t.Errorf("expected 4 loaded, got %d", report.Summary().Loaded)
+	}
+}
+
+func Test_DryRunBatches(t *testing.T) {
+	dry := newDryRun(gripql.Client{}, "test", NewLoadReport(0))
+	pending := make([]string, gidLookupBatch-1)
+	if batch := dry.take(&pending, false); batch != nil {
+		t.Error("partial batch taken before it was full")
+	}
+	pending = append(pending, "a")
+	if batch := dry.take(&pending, false); len(batch) != gidLookupBatch || len(pending) != 0 {
+		t.Errorf("expected a full batch, got %d with %d pending", len(batch), len(pending))
+	}
+}
@@ -9,12 +9,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"sync"
 
+	"github.com/bmeg/grip-endpoints/authz"
 	"github.com/bmeg/grip-graphql/middleware"
 	"github.com/bmeg/grip/gdbi"
 	"github.com/bmeg/grip/gripql"
@@ -31,81 +33,57 @@ import (
 )
 
 type Handler struct {
-	router *gin.Engine
-	client gripql.Client
-	config map[string]string
+	router       *gin.Engine
+	client       gripql.Client
+	config       map[string]string
+	dictionaries *DictionaryRegistry
+	jobs         *JobManager
+	resources    *GraphResources
+	audit        *AuditLog
 }
 
-func convertAnyToStringSlice(anySlice []any) ([]string, error) {
-	var stringSlice []string
-	for _, v := range anySlice {
-		str, ok := v.(string)
-		if !ok {
-			return nil, fmt.Errorf("element %v is not a string", v)
-		}
-		stringSlice = append(stringSlice, str)
-	}
-	return stringSlice, nil
-}
-
-func ParseAccess(c *gin.Context, resourceList []string, method string) error {
-	if len(resourceList) == 0 {
-		return &middleware.ServerError{StatusCode: 401, Message: fmt.Sprintf("User is not allowed to %s on any graph", method)}
-	}
-	for _, v := range resourceList {
-		// currently checking if the project == the graph name, but could change it so that the graph name is of form program-project and then check the full resource path
-		project := strings.Split(v, "/projects/")
-		// list-graphs whitelisted method
-		if project[1] == c.Param("graph") || c.Request.URL.Path == "list-graphs" {
-			return nil
-		}
-	}
-	return &middleware.ServerError{StatusCode: 401, Message: fmt.Sprintf("User is not allowed to %s on graph: %s", method, c.Param("graph"))}
-}
-func TokenAuthMiddleware() gin.HandlerFunc {
+func TokenAuthMiddleware(verifier *authz.Verifier, authorizer authz.Authorizer, resources *GraphResources, permissions MethodPermissions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		//c.Next()
 		requestHeaders := c.Request.Header
 		if val, ok := requestHeaders["Authorization"]; ok {
 			Token := val[0]
-			var method string
-			if c.Request.Method == http.MethodGet {
-				method = "read"
-			} else if c.Request.Method == http.MethodPost {
-				method = "create"
-			} else {
+			method, ok := permissions.Permission(c.Request.Method)
+			if !ok {
 				RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 405, Message: fmt.Sprintf("Method %s not allowed", c.Request.Method)})
 				c.Abort()
 				return
 			}
 
-			anyList, err := middleware.HandleJWTToken(Token, method)
-			if err != nil {
-				RegError(c, c.Writer, c.Param("graph"), err)
+			if err := verifier.Verify(Token); err != nil {
+				log.WithFields(log.Fields{"error": err}).Info("token verification failed")
+				RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 401, Message: fmt.Sprintf("%s", err)})
 				c.Abort()
 				return
 			}
 
-			resourceList, convErr := convertAnyToStringSlice(anyList)
-			if convErr != nil {
-				RegError(c, c.Writer, c.Param("graph"), convErr)
+			resourceList, err := authorizer.Resources(Token, method)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("authorization lookup failed")
+				RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 401, Message: fmt.Sprintf("%s", err)})
 				c.Abort()
 				return
 			}
-			fmt.Println("RESOURCE LIST: ", resourceList)
-			/* This is probably a bit too strict since there might only be 1 graph we're writing to.
-			   Instead, having create method access on at least one project is good enough permissions
-			   err = ParseAccess(c, resourceList, method)
-			   if  err != nil{
-			       RegError(c, c.Writer, c.Param("graph"), err)
-			       c.Abort()
-			       return
-			       }*/
+			log.WithFields(log.Fields{"method": method, "resources": len(resourceList)}).Debug("resolved token resources")
 			if len(resourceList) == 0 {
-				RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("User does not have access to at least one project for method %", method)})
+				RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("User does not have access to at least one project for method %s", method)})
 				c.Abort()
 				return
 			}
+			// the sub is only known to belong to the token once its signature has been checked,
+			// from here on even if the graph turns out to be off limits
+			if verifier != nil {
+				c.Set(auditUserKey, authz.Subject(Token))
+			}
+			if !ParseAccess(c, resources, resourceList, method) {
+				return
+			}
+			c.Set(resourcesKey, resourceList)
 		} else {
 			RegError(c, c.Writer, c.Param("graph"), &middleware.ServerError{StatusCode: 400, Message: "Authorization token not provided"})
 			c.Abort()
@@ -115,9 +93,22 @@ func TokenAuthMiddleware() gin.HandlerFunc {
 	}
 }
 func NewHTTPHandler(client gripql.Client, config map[string]string) (http.Handler, error) {
+	authorizer, err := authz.New(config, "")
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := authz.NewVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := NewGraphResources(config)
+	audit := NewAuditLog(client, config)
+
 	r := gin.New()
 	r.Use(gin.Logger())
-	r.Use(TokenAuthMiddleware())
+	r.Use(AuditMiddleware(audit))
+	r.Use(TokenAuthMiddleware(verifier, authorizer, resources, NewMethodPermissions(config)))
 	r.Use(gin.Recovery())
 
 	// Was getting 404s before adding this. Not 100% sure why
@@ -130,14 +121,32 @@ func NewHTTPHandler(client gripql.Client, config map[string]string) (http.Handle
 	})
 
 	h := &Handler{
-		router: r,
-		client: client,
-		config: config,
-	}
+		router:       r,
+		client:       client,
+		config:       config,
+		dictionaries: NewDictionaryRegistry(config["dictionary_dir"]),
+		jobs:         NewJobManager(),
+		resources:    resources,
+		audit:        audit,
+	}
+	h.addRoutes(r)
+	return h, nil
+}
 
+// addRoutes registers the endpoints of the handler
+func (h *Handler) addRoutes(r *gin.Engine) {
 	r.POST(":graph/add-vertex", func(c *gin.Context) {
 		h.WriteVertex(c, c.Writer, c.Request, c.Param("graph"))
 	})
+	r.POST(":graph/add-edge", func(c *gin.Context) {
+		h.WriteEdge(c, c.Writer, c.Request, c.Param("graph"))
+	})
+	r.POST(":graph/add-vertices", func(c *gin.Context) {
+		h.WriteVertices(c, c.Writer, c.Request, c.Param("graph"))
+	})
+	r.POST(":graph/add-edges", func(c *gin.Context) {
+		h.WriteEdges(c, c.Writer, c.Request, c.Param("graph"))
+	})
 	r.POST(":graph/add-graph", func(c *gin.Context) {
 		h.AddGraph(c, c.Writer, c.Request, c.Param("graph"))
 	})
@@ -150,6 +159,12 @@ func NewHTTPHandler(client gripql.Client, config map[string]string) (http.Handle
 	r.POST(":graph/add-schema", func(c *gin.Context) {
 		h.AddSchema(c, c.Writer, c.Request, c.Param("graph"))
 	})
+	r.POST(":graph/add-dictionary", func(c *gin.Context) {
+		h.AddDictionary(c, c.Writer, c.Request, c.Param("graph"))
+	})
+	r.DELETE(":graph/del-dictionary", func(c *gin.Context) {
+		h.DeleteDictionary(c, c.Writer, c.Request, c.Param("graph"))
+	})
 	r.DELETE(":graph/del-graph", func(c *gin.Context) {
 		h.DeleteGraph(c, c.Writer, c.Request, c.Param("graph"))
 	})
@@ -165,20 +180,33 @@ func NewHTTPHandler(client gripql.Client, config map[string]string) (http.Handle
 	r.GET(":graph/get-schema", func(c *gin.Context) {
 		h.GetSchema(c, c.Writer, c.Request, c.Param("graph"))
 	})
+	r.GET(":graph/get-dictionary", func(c *gin.Context) {
+		h.GetDictionary(c, c.Writer, c.Request, c.Param("graph"))
+	})
 	r.GET(":graph/get-graph", func(c *gin.Context) {
 		h.GetGraph(c, c.Writer, c.Request, c.Param("graph"))
 	})
+	r.GET(":graph/jobs", func(c *gin.Context) {
+		h.ListJobs(c, c.Writer, c.Request, c.Param("graph"))
+	})
+	r.GET(":graph/jobs/:job-id", func(c *gin.Context) {
+		h.GetJob(c, c.Writer, c.Request, c.Param("graph"), c.Param("job-id"))
+	})
+	r.DELETE(":graph/jobs/:job-id", func(c *gin.Context) {
+		h.CancelJob(c, c.Writer, c.Request, c.Param("graph"), c.Param("job-id"))
+	})
 	r.GET(":graph/get-vertex/:vertex-id", func(c *gin.Context) {
 		h.GetVertex(c, c.Writer, c.Request, c.Param("graph"), c.Param("vertex-id"))
 	})
 
+	r.GET("audit", func(c *gin.Context) {
+		h.GetAudit(c, c.Writer, c.Request)
+	})
 	r.GET("list-graphs", func(c *gin.Context) {
 		//fmt.Printf("RAW PATH: %#v\n", c.Request.URL.RawPath)
 		//fmt.Printf("PATH: %#v\n", c.Request.URL.Path)
 		h.ListGraphs(c, c.Writer)
 	})
-
-	return h, nil
 }
 
 // ServeHTTP responds to HTTP graphql requests
@@ -205,6 +233,26 @@ func RegError(c *gin.Context, writer http.ResponseWriter, graph string, err erro
 	//http.Error(writer, fmt.Sprintln("[500]	graph", graph, "error:", err), http.StatusInternalServerError)
 }
 
+// RegReject responds with a 422 for an element that failed validation, listing the
+// data dictionary violations if there are any
+func RegReject(c *gin.Context, writer http.ResponseWriter, graph string, err error) {
+	if isLookupError(err) {
+		log.WithFields(log.Fields{"graph": graph, "error": err}).Error("element check failed")
+		RegError(c, writer, graph, err)
+		return
+	}
+	log.WithFields(log.Fields{"graph": graph, "error": err}).Info("element rejected")
+	code := http.StatusUnprocessableEntity
+	if ae := (&AccessError{}); errors.As(err, &ae) {
+		code = http.StatusForbidden
+	}
+	c.JSON(code, gin.H{
+		"status":  code,
+		"message": err.Error(),
+		"data":    violations(err),
+	})
+}
+
 func (gh *Handler) ListLabels(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
 	if labels, err := gh.client.ListLabels(graph); err != nil {
 		RegError(c, writer, graph, err)
@@ -333,10 +381,17 @@ func (gh *Handler) GetEdge(c *gin.Context, writer http.ResponseWriter, request *
 }
 
 func (gh *Handler) DeleteEdge(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string, edge string) {
-	if _, err := gh.client.GetEdge(graph, edge); err == nil {
-		if err := gh.client.DeleteEdge(graph, edge); err != nil {
+	if e, err := gh.client.GetEdge(graph, edge); err == nil {
+		if err := gh.edgeAccess(request.Context(), graph, requestResources(c), e); err != nil {
+			if ae := (&AccessError{}); errors.As(err, &ae) {
+				RegReject(c, writer, graph, err)
+			} else {
+				RegError(c, writer, graph, err)
+			}
+		} else if err := gh.client.DeleteEdge(graph, edge); err != nil {
 			RegError(c, writer, graph, err)
 		} else {
+			setAuditCounts(c, 1, 0)
 			log.WithFields(log.Fields{"graph": graph}).Info(edge)
 			http.Error(writer, fmt.Sprintln("[200]	DELETE:", graph, "EDGE:", edge), http.StatusOK)
 		}
@@ -345,11 +400,24 @@ func (gh *Handler) DeleteEdge(c *gin.Context, writer http.ResponseWriter, reques
 	}
 }
 
+// edgeAccess checks the caller's access to an edge by its own auth_resource_path or, if
+// it has none, by those of the vertices it connects
+func (gh *Handler) edgeAccess(ctx context.Context, graph string, resources []string, e *gripql.Edge) error {
+	stored, err := fetchStored(ctx, gh.client, graph, []*gripql.GraphElement{{Edge: e}})
+	if err != nil {
+		return err
+	}
+	return stored.edgeResources(resources, e)
+}
+
 func (gh *Handler) DeleteVertex(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string, vertex string) {
-	if _, err := gh.client.GetVertex(graph, vertex); err == nil {
-		if err := gh.client.DeleteVertex(graph, vertex); err != nil {
+	if v, err := gh.client.GetVertex(graph, vertex); err == nil {
+		if err := checkResource(requestResources(c), v.Gid, v.GetDataMap(), true); err != nil {
+			RegReject(c, writer, graph, err)
+		} else if err := gh.client.DeleteVertex(graph, vertex); err != nil {
 			RegError(c, writer, graph, err)
 		} else {
+			setAuditCounts(c, 1, 0)
 			log.WithFields(log.Fields{"graph": graph}).Info(vertex)
 			http.Error(writer, fmt.Sprintln("[200]	DELETE:", graph, "VERTEX:", vertex), http.StatusOK)
 		}
@@ -376,14 +444,95 @@ func (gh *Handler) WriteVertex(c *gin.Context, writer http.ResponseWriter, reque
 			return
 		}
 	}
+	checks, err := gh.writeChecks(c, graph, request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	ge := &gripql.GraphElement{Vertex: v}
+	stored, err := fetchStored(request.Context(), gh.client, graph, []*gripql.GraphElement{ge})
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	if err := runChecks(checks, ge); err != nil {
+		RegReject(c, writer, graph, err)
+		return
+	}
+	if err := checkOwnership(requestResources(c), ge, stored); err != nil {
+		RegReject(c, writer, graph, err)
+		return
+	}
 	if err := gh.client.AddVertex(graph, v); err != nil {
 		RegError(c, writer, graph, err)
 	} else {
+		setAuditCounts(c, 1, 0)
 		log.WithFields(log.Fields{"graph": graph}).Info("[200]	POST	VERTEX: ", v)
 		http.Error(writer, fmt.Sprintln("[200]	POST	VERTEX: ", v), http.StatusOK)
 	}
 }
 
+// checkEdgeEndpoints verifies that both the from and to vertices of an edge exist in the graph,
+// given the vertices found by fetchVertices for the endpoints of the edges being written
+func checkEdgeEndpoints(graph string, e *gripql.Edge, vertices map[string]*gripql.Vertex) error {
+	if e.From == "" || e.To == "" {
+		return &middleware.ServerError{StatusCode: http.StatusUnprocessableEntity, Message: fmt.Sprintf("edge %s must specify both 'from' and 'to'", e.Gid)}
+	}
+	for _, id := range []string{e.From, e.To} {
+		if _, ok := vertices[id]; !ok {
+			return &middleware.ServerError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("vertex %s referenced by edge %s not found in graph %s", id, e.Gid, graph)}
+		}
+	}
+	return nil
+}
+
+func (gh *Handler) WriteEdge(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	e := &gripql.Edge{}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	if err := protojson.Unmarshal(body, e); err != nil {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("failed to parse edge: %s", err)})
+		return
+	}
+	ge := &gripql.GraphElement{Edge: e}
+	stored, err := fetchStored(request.Context(), gh.client, graph, []*gripql.GraphElement{ge})
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	if err := checkEdgeEndpoints(graph, e, stored.vertices); err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	checks, err := gh.writeChecks(c, graph, request)
+	if err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	if err := runChecks(checks, ge); err != nil {
+		RegReject(c, writer, graph, err)
+		return
+	}
+	if err := checkOwnership(requestResources(c), ge, stored); err != nil {
+		RegReject(c, writer, graph, err)
+		return
+	}
+	if err := gh.client.AddEdge(graph, e); err != nil {
+		RegError(c, writer, graph, err)
+		return
+	}
+	setAuditCounts(c, 1, 0)
+	log.WithFields(log.Fields{"graph": graph}).Info("[200]	POST	EDGE: ", e)
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "POST add-edge successful",
+		"data":    gin.H{"gid": e.Gid, "label": e.Label, "from": e.From, "to": e.To},
+	})
+}
+
 func HandleBody(request *http.Request) (map[string]any, error) {
 	var body []byte
 	var err error
@@ -410,126 +559,178 @@ func (gh *Handler) MongoBulk(c *gin.Context, writer http.ResponseWriter, request
 	var logRate = 10000
 	var bulkBufferSize = 1000
 
-	err := request.ParseMultipartForm(1024 * 1024 * 1024) // 10 GB limit
+	load, err := parseLoadRequest(request)
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to parse multipart form: %s", err)})
+		RegError(c, writer, graph, err)
 		return
 	}
+	fail := func(err error) {
+		load.Close()
+		RegError(c, writer, graph, err)
+	}
 
-	args := request.MultipartForm.Value
-	request_type_list, ok := args["type"]
-	if !ok {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: "Server must specify GraphElement Type, no value found for 'type'"})
+	request_type := load.Value("type")
+	if request_type != "vertex" && request_type != "edge" {
+		fail(&middleware.ServerError{StatusCode: 400, Message: "Server must specify GraphElement Type, 'type' must be one of 'vertex' or 'edge'"})
 		return
 	}
-	request_type := request_type_list[0]
-	fill_gid_list, ok := args["fill_gid"]
-	var fill_gid string
-	if ok {
-		fill_gid = fill_gid_list[0]
-	}
+	fill_gid := load.Value("fill_gid")
 
-	mongoHost_list, ok := args["mongo_host"]
-	var mongoHost string
-	if ok {
-		mongoHost = mongoHost_list[0]
-	} else if !ok {
+	mongoHost := load.Value("mongo_host")
+	if mongoHost == "" {
 		mongoHost = "mongodb://local-mongodb"
 	}
 
-	file, handler, err := request.FormFile("file")
+	async, err := load.Async()
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to parse attached file: %s", err)})
+		fail(err)
 		return
 	}
-	file.Close()
-
-	client, err := mgo.NewClient(options.Client().ApplyURI(mongoHost))
+	report, err := load.Report()
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+		fail(err)
 		return
 	}
-
-	err = client.Connect(context.TODO())
+	checks, err := gh.loadChecks(c, graph, load)
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+		fail(err)
 		return
 	}
+	resources := requestResources(c)
 
-	vertexCol := client.Database(database).Collection(fmt.Sprintf("%s_vertices", graph))
-	edgeCol := client.Database(database).Collection(fmt.Sprintf("%s_edges", graph))
-
-	if request_type == "vertex" {
-		log.Infof("Loading vertex file: %s", handler.Filename)
-		vertInserter := db.NewUnorderedBufferedBulkInserter(vertexCol, bulkBufferSize).
-			SetBypassDocumentValidation(true).
-			SetOrdered(false).
-			SetUpsert(true)
+	// a dry run parses and serializes the file without connecting to mongo
+	var dry *dryRun
+	var client *mgo.Client
+	var inserter *db.BufferedBulkInserter
+	if isTrue(load.Value("dry_run")) {
+		dry = newDryRun(gh.client, graph, report)
+	} else {
+		client, err = mgo.NewClient(options.Client().ApplyURI(mongoHost))
+		if err != nil {
+			fail(&middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+			return
+		}
 
-		vertChan, err := StreamVerticesFromReader(file, workerCount)
+		err = client.Connect(context.TODO())
 		if err != nil {
-			RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+			fail(&middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
 			return
 		}
-		dataChan := vertexSerialize(vertChan, workerCount)
-		count := 0
-		for d := range dataChan {
-			vertInserter.InsertRaw(d)
-			if count%logRate == 0 {
-				log.Infof("Loaded %d vertices", count)
-			}
-			count++
+
+		collection := client.Database(database).Collection(fmt.Sprintf("%s_vertices", graph))
+		if request_type == "edge" {
+			collection = client.Database(database).Collection(fmt.Sprintf("%s_edges", graph))
 		}
-		log.Infof("Loaded %d vertices", count)
-		vertInserter.Flush()
-	}
-	if request_type == "edge" {
-		log.Infof("Loading edge file: %s", handler.Filename)
-		edgeInserter := db.NewUnorderedBufferedBulkInserter(edgeCol, bulkBufferSize).
+		inserter = db.NewUnorderedBufferedBulkInserter(collection, bulkBufferSize).
 			SetBypassDocumentValidation(true).
 			SetOrdered(false).
 			SetUpsert(true)
+	}
 
-		edgeChan, err := StreamEdgesFromReader(file, workerCount)
+	job := gh.jobs.New(graph, "mongo-load", load.name, report)
+	gh.runLoad(c, graph, job, load, async, func() {
+		if client != nil {
+			defer client.Disconnect(context.Background())
+		}
+
+		log.Infof("Loading %s file: %s", request_type, load.name)
+		elemChan, err := StreamElementsFromReader(load.reader, request_type, workerCount, report, checks)
 		if err != nil {
-			RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+			report.Fail(err)
 			return
 		}
-		dataChan := edgeSerialize(edgeChan, fill_gid, workerCount)
+		elemChan = ownedElements(gh.client, graph, resources, elemChan, report)
+		var dataChan chan dataLine
+		if request_type == "vertex" {
+			dataChan = vertexSerialize(elemChan, workerCount, report)
+		} else {
+			dataChan = edgeSerialize(elemChan, fill_gid, workerCount, report)
+		}
+
 		count := 0
 		for d := range dataChan {
-			edgeInserter.InsertRaw(d)
-			if count%logRate == 0 {
-				log.Infof("Loaded %d edges", count)
+			// keep draining after an abort so the upstream workers can exit
+			if report.IsAborted() {
+				continue
+			}
+			if dry != nil {
+				if request_type == "vertex" {
+					dry.AddVertex(d.gid, d.label)
+				} else {
+					dry.AddEdge(d.gid, d.label)
+				}
+				continue
+			}
+			if _, err := inserter.InsertRaw(d.data); err != nil {
+				report.Fail(fmt.Errorf("mongo insert failed near line %d: %s", d.line, err))
+				continue
 			}
+			report.AddLoaded(1)
 			count++
+			if count%logRate == 0 {
+				log.Infof("Loaded %d %s elements", count, request_type)
+			}
 		}
-		log.Infof("Loaded %d vertices", count)
-		edgeInserter.Flush()
-	}
+		if dry != nil {
+			report.SetDryRun(dry.Finish())
+		} else if !report.IsAborted() {
+			if _, err := inserter.Flush(); err != nil {
+				report.Fail(fmt.Errorf("mongo insert failed: %s", err))
+			}
+		}
+		log.Infof("Loaded total of %d %s elements", count, request_type)
+	})
+}
 
-	responseData := map[string]string{"status": "200", "message": "File uploaded successfully"}
-	responseJSON, err := json.Marshal(responseData)
-	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
-		return
-	}
+// loadResponse writes the result of a bulk load
+func loadResponse(c *gin.Context, graph string, report *LoadReport) {
+	summary := report.Summary()
+	code := http.StatusOK
+	message := "File uploaded successfully"
+	if summary.Aborted {
+		code = report.StatusCode()
+		message = summary.Error
+	} else if summary.DryRun != nil {
+		message = fmt.Sprintf("Dry run: %d elements would be loaded, %d rejected lines, %d gids already exist", summary.Loaded, summary.Rejected, summary.DryRun.Existing)
+	} else if summary.Rejected > 0 {
+		message = fmt.Sprintf("File uploaded with %d rejected lines", summary.Rejected)
+	}
+	log.WithFields(log.Fields{"graph": graph, "loaded": summary.Loaded, "rejected": summary.Rejected}).Info(message)
+	setAuditCounts(c, summary.Loaded, summary.Rejected)
+	c.JSON(code, gin.H{
+		"status":  code,
+		"message": message,
+		"data":    summary,
+	})
+}
+
+// line is a single line of an NDJSON stream and its 1-based line number
+type line struct {
+	num  int
+	text string
+}
 
-	writer.WriteHeader(http.StatusOK)
-	writer.Write(responseJSON)
+type dataLine struct {
+	line  int
+	gid   string
+	label string
+	data  []byte
 }
 
-func vertexSerialize(vertChan chan *gripql.Vertex, workers int) chan []byte {
-	dataChan := make(chan []byte, workers)
+func vertexSerialize(vertChan chan elementLine, workers int, report *LoadReport) chan dataLine {
+	dataChan := make(chan dataLine, workers)
 	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			for v := range vertChan {
+			for e := range vertChan {
+				v := e.elem.Vertex
 				doc := mongo.PackVertex(gdbi.NewElementFromVertex(v))
 				rawBytes, err := bson.Marshal(doc)
-				if err == nil {
-					dataChan <- rawBytes
+				if err != nil {
+					report.Reject(e.line, v.Gid, fmt.Errorf("bson marshal: %s", err))
+				} else {
+					dataChan <- dataLine{line: e.line, gid: v.Gid, label: v.Label, data: rawBytes}
 				}
 			}
 			wg.Done()
@@ -542,20 +743,23 @@ func vertexSerialize(vertChan chan *gripql.Vertex, workers int) chan []byte {
 	return dataChan
 }
 
-func edgeSerialize(edgeChan chan *gripql.Edge, fill_gid string, workers int) chan []byte {
-	dataChan := make(chan []byte, workers)
+func edgeSerialize(edgeChan chan elementLine, fill_gid string, workers int, report *LoadReport) chan dataLine {
+	dataChan := make(chan dataLine, workers)
 	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			for e := range edgeChan {
+			for l := range edgeChan {
+				e := l.elem.Edge
 				if fill_gid != "" && e.Gid == "" {
 					e.Gid = util.UUID()
 				}
 				doc := mongo.PackEdge(gdbi.NewElementFromEdge(e))
 				rawBytes, err := bson.Marshal(doc)
-				if err == nil {
-					dataChan <- rawBytes
+				if err != nil {
+					report.Reject(l.line, e.Gid, fmt.Errorf("bson marshal: %s", err))
+				} else {
+					dataChan <- dataLine{line: l.line, gid: e.Gid, label: e.Label, data: rawBytes}
 				}
 			}
 			wg.Done()
@@ -572,140 +776,176 @@ func (gh *Handler) BulkStream(c *gin.Context, writer http.ResponseWriter, reques
 	host := "localhost:8202"
 	var logRate = 10000
 
-	err := request.ParseMultipartForm(1024 * 1024 * 1024) // 10 GB limit
+	load, err := parseLoadRequest(request)
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("Error parsing form: %s", err)})
+		RegError(c, writer, graph, err)
 		return
 	}
+	fail := func(err error) {
+		load.Close()
+		RegError(c, writer, graph, err)
+	}
 
-	types, ok := request.MultipartForm.Value["types"]
-	if !ok || len(types) == 0 {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("types field not found in form: %s", err)})
+	request_type := load.Value("types")
+	if request_type == "" {
+		request_type = load.Value("type")
+	}
+	if request_type != "vertex" && request_type != "edge" && request_type != "mixed" {
+		fail(&middleware.ServerError{StatusCode: 400, Message: "Server must specify GraphElement Type, 'types' must be one of 'vertex', 'edge' or 'mixed'"})
 		return
 	}
-	request_type := types[0]
 
-	// Get the file from the form data
-	file, handler, err := request.FormFile("file")
+	async, err := load.Async()
 	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to parse attached file: %s", err)})
+		fail(err)
 		return
 	}
-	defer file.Close()
-
-	conn, err := gripql.Connect(rpc.ConfigWithDefaults(host), true)
-	elemChan := make(chan *gripql.GraphElement)
-	wait := make(chan bool)
-	go func() {
-		if err := conn.BulkAdd(elemChan); err != nil {
-			log.Errorf("bulk add error: %v", err)
-		}
-		wait <- false
-	}()
+	report, err := load.Report()
+	if err != nil {
+		fail(err)
+		return
+	}
+	checks, err := gh.loadChecks(c, graph, load)
+	if err != nil {
+		fail(err)
+		return
+	}
+	resources := requestResources(c)
 
-	if request_type == "vertex" {
-		log.Infof("Loading vertex file: %s", handler.Filename)
-		VertChan, err := StreamVerticesFromReader(file, 5)
+	// a dry run parses and checks the file without connecting to grip for writes
+	var dry *dryRun
+	var conn gripql.Client
+	if isTrue(load.Value("dry_run")) {
+		dry = newDryRun(gh.client, graph, report)
+	} else {
+		conn, err = gripql.Connect(rpc.ConfigWithDefaults(host), true)
 		if err != nil {
-			RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+			fail(&middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
 			return
 		}
-		count := 0
-		for v := range VertChan {
-			count++
-			if count%logRate == 0 {
-				log.Infof("Loaded %d vertices", count)
-			}
-			elemChan <- &gripql.GraphElement{Graph: graph, Vertex: v}
-		}
-		log.Infof("Loaded total of %d vertices", count)
 	}
-	if request_type == "edge" {
-		log.Infof("Loading edge file: %s", handler.Filename)
-		EdgeChan, err := StreamEdgesFromReader(file, 5)
+
+	job := gh.jobs.New(graph, "bulk-load", load.name, report)
+	gh.runLoad(c, graph, job, load, async, func() {
+		elemChan := make(chan *gripql.GraphElement)
+		wait := make(chan bool)
+		go func() {
+			if dry != nil {
+				for range elemChan {
+				}
+			} else if err := conn.BulkAdd(elemChan); err != nil {
+				log.Errorf("bulk add error: %v", err)
+				report.Fail(fmt.Errorf("bulk add error: %s", err))
+			}
+			wait <- false
+		}()
+
+		log.Infof("Loading %s file: %s", request_type, load.name)
+		ElemChan, err := StreamElementsFromReader(load.reader, request_type, 5, report, checks)
 		if err != nil {
-			RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("%s", err)})
+			close(elemChan)
+			<-wait
+			report.Fail(err)
 			return
 		}
-		count := 0
-		for e := range EdgeChan {
-			count++
-			if count%logRate == 0 {
-				log.Infof("Loaded %d vertices", count)
+		ElemChan = ownedElements(gh.client, graph, resources, ElemChan, report)
+		vertCount, edgeCount := 0, 0
+		for e := range ElemChan {
+			// keep draining after an abort so the upstream workers can exit
+			if report.IsAborted() {
+				continue
+			}
+			e.elem.Graph = graph
+			if dry != nil {
+				if e.elem.Vertex != nil {
+					dry.AddVertex(e.elem.Vertex.Gid, e.elem.Vertex.Label)
+				} else {
+					dry.AddEdge(e.elem.Edge.Gid, e.elem.Edge.Label)
+				}
+				continue
+			}
+			select {
+			case elemChan <- e.elem:
+			case <-report.Done():
+				continue
+			}
+			report.AddLoaded(1)
+			if e.elem.Vertex != nil {
+				vertCount++
+			} else {
+				edgeCount++
+			}
+			if (vertCount+edgeCount)%logRate == 0 {
+				log.Infof("Loaded %d vertices and %d edges", vertCount, edgeCount)
 			}
-			elemChan <- &gripql.GraphElement{Graph: graph, Edge: e}
 		}
-		log.Infof("Loaded total of %d edges", count)
-	}
+		log.Infof("Loaded total of %d vertices and %d edges", vertCount, edgeCount)
 
-	close(elemChan)
-	<-wait
+		close(elemChan)
+		<-wait
+		if dry != nil {
+			report.SetDryRun(dry.Finish())
+		}
+	})
+}
 
-	responseData := map[string]string{"status": "200", "message": "File uploaded successfully"}
-	responseJSON, err := json.Marshal(responseData)
-	if err != nil {
-		RegError(c, writer, graph, &middleware.ServerError{StatusCode: 500, Message: fmt.Sprintf("Error encoding JSON response %s", err)})
-		return
-	}
+type elementLine struct {
+	line int
+	elem *gripql.GraphElement
+}
 
-	writer.WriteHeader(http.StatusOK)
-	writer.Write(responseJSON)
+// elementKind is the discriminator of a line in a mixed element file
+type elementKind struct {
+	Type string `json:"type"`
 }
 
-func StreamEdgesFromReader(reader io.Reader, workers int) (chan *gripql.Edge, error) {
-	if workers < 1 {
-		workers = 1
+// parseElement unmarshals a line of a bulk load file. In 'vertex' and 'edge' mode the line is
+// the element itself. In 'mixed' mode the line is either a gripql.GraphElement, i.e.
+// {"vertex": {...}} or {"edge": {...}}, or a vertex/edge with a "type" discriminator field.
+func parseElement(jum protojson.UnmarshalOptions, kind string, text []byte) (*gripql.GraphElement, error) {
+	if kind == "mixed" {
+		ge := &gripql.GraphElement{}
+		if err := jum.Unmarshal(text, ge); err == nil && (ge.Vertex != nil || ge.Edge != nil) {
+			return ge, nil
+		}
+		k := elementKind{}
+		if err := json.Unmarshal(text, &k); err != nil {
+			return nil, err
+		}
+		if k.Type != "vertex" && k.Type != "edge" {
+			return nil, fmt.Errorf("line is not a GraphElement and has no 'type' of 'vertex' or 'edge'")
+		}
+		kind = k.Type
 	}
-	if workers > 99 {
-		workers = 99
+	if kind == "vertex" {
+		v := &gripql.Vertex{}
+		if err := jum.Unmarshal(text, v); err != nil {
+			return nil, err
+		}
+		return &gripql.GraphElement{Vertex: v}, nil
 	}
-	lineChan, err := processReader(reader, workers)
-	if err != nil {
+	e := &gripql.Edge{}
+	if err := jum.Unmarshal(text, e); err != nil {
 		return nil, err
 	}
-
-	edgeChan := make(chan *gripql.Edge, workers)
-	var wg sync.WaitGroup
-
-	jum := protojson.UnmarshalOptions{DiscardUnknown: true}
-
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			for line := range lineChan {
-				e := &gripql.Edge{}
-				err := jum.Unmarshal([]byte(line), e)
-				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Errorf("Unmarshaling edge: %s", line)
-
-				} else {
-					edgeChan <- e
-				}
-			}
-			wg.Done()
-		}()
-	}
-
-	go func() {
-		wg.Wait()
-		close(edgeChan)
-	}()
-
-	return edgeChan, nil
+	return &gripql.GraphElement{Edge: e}, nil
 }
-func StreamVerticesFromReader(reader io.Reader, workers int) (chan *gripql.Vertex, error) {
+
+// StreamElementsFromReader parses a file of vertices, edges or a mix of both (kind is one of
+// 'vertex', 'edge' or 'mixed') into GraphElements
+func StreamElementsFromReader(reader io.Reader, kind string, workers int, report *LoadReport, checks []elementCheck) (chan elementLine, error) {
 	if workers < 1 {
 		workers = 1
 	}
 	if workers > 99 {
 		workers = 99
 	}
-	lineChan, err := processReader(reader, workers)
+	lineChan, err := processReader(reader, workers, report)
 	if err != nil {
 		return nil, err
 	}
 
-	vertChan := make(chan *gripql.Vertex, workers)
+	elemChan := make(chan elementLine, workers)
 	var wg sync.WaitGroup
 
 	jum := protojson.UnmarshalOptions{DiscardUnknown: true}
@@ -714,12 +954,14 @@ func StreamVerticesFromReader(reader io.Reader, workers int) (chan *gripql.Verte
 		wg.Add(1)
 		go func() {
 			for line := range lineChan {
-				v := &gripql.Vertex{}
-				err := jum.Unmarshal([]byte(line), v)
+				ge, err := parseElement(jum, kind, []byte(line.text))
 				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Errorf("Unmarshaling vertex: %s", line)
+					log.WithFields(log.Fields{"error": err, "line": line.num}).Errorf("Unmarshaling %s: %s", kind, line.text)
+					report.Reject(line.num, "", err)
+				} else if err := runChecks(checks, ge); err != nil {
+					report.RejectCheck(line.num, elementGid(ge), err)
 				} else {
-					vertChan <- v
+					elemChan <- elementLine{line: line.num, elem: ge}
 				}
 			}
 			wg.Done()
@@ -728,31 +970,43 @@ func StreamVerticesFromReader(reader io.Reader, workers int) (chan *gripql.Verte
 
 	go func() {
 		wg.Wait()
-		close(vertChan)
+		close(elemChan)
 	}()
 
-	return vertChan, nil
+	return elemChan, nil
 }
 
-func processReader(reader io.Reader, chansize int) (<-chan string, error) {
+// processReader splits the reader into numbered lines. Blank lines are skipped but still
+// counted so that line numbers in the load report match the uploaded file.
+func processReader(reader io.Reader, chansize int, report *LoadReport) (<-chan line, error) {
 	scanner := bufio.NewScanner(reader)
 
 	buf := make([]byte, 0, 64*1024)
 	maxCapacity := 16 * 1024 * 1024
 	scanner.Buffer(buf, maxCapacity)
 
-	lineChan := make(chan string, chansize)
+	lineChan := make(chan line, chansize)
 
 	go func() {
+		defer close(lineChan)
+		num := 0
 		for scanner.Scan() {
-			line := scanner.Text()
-			lineChan <- line
+			num++
+			text := scanner.Text()
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			select {
+			case lineChan <- line{num: num, text: text}:
+			case <-report.Done():
+				return
+			}
 		}
 
 		if err := scanner.Err(); err != nil {
-			log.WithFields(log.Fields{"error reading from reader: ": err})
+			log.WithFields(log.Fields{"error": err}).Error("error reading from reader")
+			report.Fail(fmt.Errorf("error reading line %d: %s", num+1, err))
 		}
-		close(lineChan)
 	}()
 
 	return lineChan, nil
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/log"
+	"github.com/bmeg/grip/util"
+	"github.com/gin-gonic/gin"
+)
+
+// maxFinishedJobs is the number of finished jobs kept for status queries
+const maxFinishedJobs = 100
+
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Job is a bulk load tracked by the JobManager. Jobs are independent of the request
+// that started them, so their state is kept when the client goes away
+type Job struct {
+	ID        string
+	Graph     string
+	Operation string
+	Source    string
+	Report    *LoadReport
+
+	done      chan struct{}
+	mu        sync.Mutex
+	state     JobState
+	cancelled bool
+	created   time.Time
+	finished  time.Time
+}
+
+// JobStatus is the serializable state of a job
+type JobStatus struct {
+	ID                string      `json:"id"`
+	Graph             string      `json:"graph"`
+	Operation         string      `json:"operation"`
+	Source            string      `json:"source"`
+	State             JobState    `json:"state"`
+	Created           time.Time   `json:"created"`
+	Finished          *time.Time  `json:"finished,omitempty"`
+	ElapsedSeconds    float64     `json:"elapsed_seconds"`
+	ElementsPerSecond float64     `json:"elements_per_second"`
+	Report            LoadSummary `json:"report"`
+}
+
+// Status returns a snapshot of the job, with throughput computed over the elapsed time
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	end := time.Now()
+	var finished *time.Time
+	if j.state != JobRunning {
+		end = j.finished
+		f := j.finished
+		finished = &f
+	}
+	summary := j.Report.Summary()
+	elapsed := end.Sub(j.created).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(summary.Loaded) / elapsed
+	}
+	return JobStatus{
+		ID:                j.ID,
+		Graph:             j.Graph,
+		Operation:         j.Operation,
+		Source:            j.Source,
+		State:             j.state,
+		Created:           j.created,
+		Finished:          finished,
+		ElapsedSeconds:    elapsed,
+		ElementsPerSecond: rate,
+		Report:            summary,
+	}
+}
+
+// Cancel stops a running job
+func (j *Job) Cancel() {
+	j.mu.Lock()
+	j.cancelled = true
+	j.mu.Unlock()
+	j.Report.abort(fmt.Errorf("load cancelled"), http.StatusConflict)
+}
+
+// Done is closed when the job has finished
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Finish sets the final state of the job from its report
+func (j *Job) Finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer close(j.done)
+	j.finished = time.Now()
+	switch {
+	case j.cancelled:
+		j.state = JobCancelled
+	case j.Report.IsAborted():
+		j.state = JobFailed
+	default:
+		j.state = JobSucceeded
+	}
+}
+
+// JobManager keeps the running jobs and the most recent finished ones
+type JobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewJobManager() *JobManager {
+	return &JobManager{jobs: map[string]*Job{}}
+}
+
+// New registers a running job for a load
+func (jm *JobManager) New(graph string, operation string, source string, report *LoadReport) *Job {
+	job := &Job{
+		ID:        util.UUID(),
+		Graph:     graph,
+		Operation: operation,
+		Source:    source,
+		Report:    report,
+		done:      make(chan struct{}),
+		state:     JobRunning,
+		created:   time.Now(),
+	}
+	report.SetJobID(job.ID)
+	jm.mu.Lock()
+	jm.jobs[job.ID] = job
+	jm.mu.Unlock()
+	jm.prune()
+	return job
+}
+
+func (jm *JobManager) Get(graph string, id string) (*Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	job, ok := jm.jobs[id]
+	if !ok || job.Graph != graph {
+		return nil, false
+	}
+	return job, true
+}
+
+// List returns the status of the jobs of a graph, most recent first
+func (jm *JobManager) List(graph string) []JobStatus {
+	jm.mu.Lock()
+	jobs := []*Job{}
+	for _, job := range jm.jobs {
+		if job.Graph == graph {
+			jobs = append(jobs, job)
+		}
+	}
+	jm.mu.Unlock()
+	out := make([]JobStatus, len(jobs))
+	for i, job := range jobs {
+		out[i] = job.Status()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.After(out[j].Created)
+	})
+	return out
+}
+
+// prune drops the oldest finished jobs past maxFinishedJobs
+func (jm *JobManager) prune() {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	finished := []*Job{}
+	for _, job := range jm.jobs {
+		job.mu.Lock()
+		if job.state != JobRunning {
+			finished = append(finished, job)
+		}
+		job.mu.Unlock()
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].finished.Before(finished[j].finished)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(jm.jobs, job.ID)
+	}
+}
+
+// runLoad runs a load as a job and closes its data stream when done. With async set the job
+// runs in the background and the response is a 202 with the job, otherwise it is the load report.
+// The job never uses the request context so it is not cut short when the client goes away.
+func (gh *Handler) runLoad(c *gin.Context, graph string, job *Job, load *loadRequest, async bool, run func()) {
+	if async {
+		c.Set(auditJobKey, job)
+		go func() {
+			defer load.Close()
+			run()
+			job.Finish()
+			log.WithFields(log.Fields{"graph": graph, "job": job.ID, "state": job.Status().State}).Info("load job finished")
+		}()
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":  http.StatusAccepted,
+			"message": fmt.Sprintf("%s job %s started", job.Operation, job.ID),
+			"data":    job.Status(),
+		})
+		return
+	}
+	run()
+	load.Close()
+	job.Finish()
+	loadResponse(c, graph, job.Report)
+}
+
+func (gh *Handler) ListJobs(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "GET jobs successful",
+		"data":    gh.jobs.List(graph),
+	})
+}
+
+func (gh *Handler) GetJob(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string, id string) {
+	job, ok := gh.jobs.Get(graph, id)
+	if !ok {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("job %s not found in graph %s", id, graph)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": "GET job successful",
+		"data":    job.Status(),
+	})
+}
+
+func (gh *Handler) CancelJob(c *gin.Context, writer http.ResponseWriter, request *http.Request, graph string, id string) {
+	job, ok := gh.jobs.Get(graph, id)
+	if !ok {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("job %s not found in graph %s", id, graph)})
+		return
+	}
+	if job.Status().State != JobRunning {
+		RegError(c, writer, graph, &middleware.ServerError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("job %s is not running", id)})
+		return
+	}
+	job.Cancel()
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "200",
+		"message": fmt.Sprintf("job %s cancelled", id),
+		"data":    job.Status(),
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_JobLifecycle(t *testing.T) {
+	jm := NewJobManager()
+	done := jm.New("g1", "bulk-load", "a.json", NewLoadReport(0))
+	done.Report.AddLoaded(10)
+	done.Finish()
+	cancelled := jm.New("g1", "bulk-load", "b.json", NewLoadReport(0))
+	cancelled.Cancel()
+	cancelled.Finish()
+	failed := jm.New("g1", "mongo-load", "c.json", NewLoadReport(0))
+	failed.Report.Fail(fmt.Errorf("write failed"))
+	failed.Finish()
+	running := jm.New("g2", "bulk-load", "d.json", NewLoadReport(0))
+
+	for job, state := range map[*Job]JobState{done: JobSucceeded, cancelled: JobCancelled, failed: JobFailed, running: JobRunning} {
+		if s := job.Status(); s.State != state {
+			t.Errorf("job %s: expected state %s, got %s", s.Source, state, s.State)
+		}
+	}
+	if s := done.Status(); s.Report.Loaded != 10 || s.Report.JobID != done.ID || s.Finished == nil {
+		t.Errorf("unexpected status %+v", s)
+	}
+	if _, ok := jm.Get("g2", done.ID); ok {
+		t.Error("job found under the wrong graph")
+	}
+	if l := jm.List("g1"); len(l) != 3 {
+		t.Errorf("expected 3 jobs for g1, got %d", len(l))
+	}
+}
+
+func Test_JobManagerPrune(t *testing.T) {
+	jm := NewJobManager()
+	running := jm.New("g", "bulk-load", "running.json", NewLoadReport(0))
+	for i := 0; i < maxFinishedJobs+10; i++ {
+		jm.New("g", "bulk-load", fmt.Sprintf("%d.json", i), NewLoadReport(0)).Finish()
+	}
+	jm.prune()
+	if l := jm.List("g"); len(l) != maxFinishedJobs+1 {
+		t.Errorf("expected %d jobs after pruning, got %d", maxFinishedJobs+1, len(l))
+	}
+	if _, ok := jm.Get("g", running.ID); !ok {
+		t.Error("running job was pruned")
+	}
+}
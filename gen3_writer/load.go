@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// loadRequest is the data stream and options of a bulk load. The data is either the 'file'
+// part of a multipart form, with options taken from the form values, or a raw NDJSON
+// request body, with options taken from the query string.
+type loadRequest struct {
+	reader   io.Reader
+	closers  []io.Closer
+	name     string
+	encoding string
+	counter  *countingReader
+	values   map[string][]string
+	streamed bool
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (cr *countingReader) Count() int64 {
+	return cr.n.Load()
+}
+
+// isNDJSON reports whether the request body is a raw NDJSON stream
+func isNDJSON(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == ndjsonContentType
+}
+
+// parseLoadRequest sets up the data stream for a bulk load. Raw NDJSON bodies are read
+// straight from the connection, so arbitrarily large (and chunked) uploads load in bounded memory.
+func parseLoadRequest(request *http.Request) (*loadRequest, error) {
+	var lr *loadRequest
+	var encoding string
+	if isNDJSON(request) {
+		lr = &loadRequest{
+			reader:   request.Body,
+			closers:  []io.Closer{request.Body},
+			name:     "request body",
+			values:   request.URL.Query(),
+			streamed: true,
+		}
+		encoding = request.Header.Get("Content-Encoding")
+	} else {
+		err := request.ParseMultipartForm(1024 * 1024 * 1024) // 10 GB limit
+		if err != nil {
+			return nil, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to parse multipart form: %s", err)}
+		}
+		file, handler, err := request.FormFile("file")
+		if err != nil {
+			return nil, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to parse attached file: %s", err)}
+		}
+		lr = &loadRequest{
+			reader:  file,
+			closers: []io.Closer{file},
+			name:    handler.Filename,
+			values:  request.MultipartForm.Value,
+		}
+		encoding = handler.Header.Get("Content-Encoding")
+	}
+	if err := lr.decompress(encoding); err != nil {
+		lr.Close()
+		return nil, err
+	}
+	return lr, nil
+}
+
+// decompress wraps the data stream in a gzip or zstd decoder. The compression is taken from
+// the Content-Encoding header if set, otherwise it is detected from the magic bytes of the stream
+func (lr *loadRequest) decompress(encoding string) error {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "identity" {
+		br := bufio.NewReader(lr.reader)
+		magic, _ := br.Peek(len(zstdMagic))
+		lr.reader = br
+		switch {
+		case bytes.HasPrefix(magic, gzipMagic):
+			encoding = "gzip"
+		case bytes.HasPrefix(magic, zstdMagic):
+			encoding = "zstd"
+		default:
+			encoding = ""
+		}
+	}
+	switch encoding {
+	case "":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(lr.reader)
+		if err != nil {
+			return &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to open gzip stream: %s", err)}
+		}
+		lr.reader = gz
+		lr.closers = append(lr.closers, gz)
+	case "zstd":
+		zr, err := zstd.NewReader(lr.reader)
+		if err != nil {
+			return &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("failed to open zstd stream: %s", err)}
+		}
+		rc := zr.IOReadCloser()
+		lr.reader = rc
+		lr.closers = append(lr.closers, rc)
+	default:
+		return &middleware.ServerError{StatusCode: http.StatusUnsupportedMediaType, Message: fmt.Sprintf("unsupported Content-Encoding '%s', must be one of gzip or zstd", encoding)}
+	}
+	lr.encoding = encoding
+	lr.counter = &countingReader{reader: lr.reader}
+	lr.reader = lr.counter
+	return nil
+}
+
+// Value returns the first value of an option, or "" if it was not set
+func (lr *loadRequest) Value(key string) string {
+	if v, ok := lr.values[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Async reports whether the load should run as a background job. Raw NDJSON bodies are read
+// from the connection as they arrive, so they can only be loaded while the request is open.
+// Multipart uploads are spooled by the server before the handler runs; the spooled file is
+// unlinked when the request ends but stays readable through the open handle.
+func (lr *loadRequest) Async() (bool, error) {
+	if !isTrue(lr.Value("async")) {
+		return false, nil
+	}
+	if lr.streamed {
+		return false, &middleware.ServerError{StatusCode: 400, Message: "async loads require a multipart upload, raw NDJSON bodies are loaded while the request is open"}
+	}
+	return true, nil
+}
+
+// Close closes the decompressor and then the underlying stream
+func (lr *loadRequest) Close() error {
+	var err error
+	for i := len(lr.closers) - 1; i >= 0; i-- {
+		if cerr := lr.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Report creates the load report, applying the optional max_errors threshold
+func (lr *loadRequest) Report() (*LoadReport, error) {
+	maxErrors := 0
+	if v := lr.Value("max_errors"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, &middleware.ServerError{StatusCode: 400, Message: fmt.Sprintf("max_errors must be a non-negative integer, got '%s'", v)}
+		}
+		maxErrors = n
+	}
+	report := NewLoadReport(maxErrors)
+	report.SetSource(lr.encoding, lr.counter)
+	return report, nil
+}
+
+// loadChecks builds the checks applied to every element of a bulk load. The caller's
+// access to the auth_resource_path of each element is checked first
+func (gh *Handler) loadChecks(c *gin.Context, graph string, lr *loadRequest) ([]elementCheck, error) {
+	checks := []elementCheck{resourceCheck(requestResources(c))}
+	sv, err := gh.schemaValidator(graph, lr.Value("validate_schema"))
+	if err != nil {
+		return nil, err
+	}
+	if sv != nil {
+		checks = append(checks, sv.Check)
+	}
+	dict, err := gh.dictionaries.Get(graph)
+	if err != nil {
+		return nil, err
+	}
+	if dict != nil {
+		checks = append(checks, dict.Check)
+	}
+	return checks, nil
+}
+
+// writeChecks builds the checks applied by the single element and batch write endpoints,
+// which take their options from the query string
+func (gh *Handler) writeChecks(c *gin.Context, graph string, request *http.Request) ([]elementCheck, error) {
+	return gh.loadChecks(c, graph, &loadRequest{values: request.URL.Query()})
+}
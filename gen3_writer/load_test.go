@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func Test_LoadRequestDecompress(t *testing.T) {
+	data := []byte("{\"gid\": \"a\"}\n{\"gid\": \"b\"}\n")
+
+	gzBuf := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBuf)
+	gz.Write(data)
+	gz.Close()
+
+	zstBuf := &bytes.Buffer{}
+	zw, _ := zstd.NewWriter(zstBuf)
+	zw.Write(data)
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		body     []byte
+		header   string
+		encoding string
+	}{
+		{name: "plain", body: data, encoding: ""},
+		{name: "gzip sniffed", body: gzBuf.Bytes(), encoding: "gzip"},
+		{name: "zstd sniffed", body: zstBuf.Bytes(), encoding: "zstd"},
+		{name: "gzip header", body: gzBuf.Bytes(), header: "gzip", encoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lr := &loadRequest{reader: bytes.NewReader(tt.body)}
+			if err := lr.decompress(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(lr.reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("unexpected output %q", out)
+			}
+			if lr.encoding != tt.encoding {
+				t.Errorf("expected encoding %q got %q", tt.encoding, lr.encoding)
+			}
+			if lr.counter.Count() != int64(len(data)) {
+				t.Errorf("expected %d decompressed bytes got %d", len(data), lr.counter.Count())
+			}
+			lr.Close()
+		})
+	}
+
+	lr := &loadRequest{reader: bytes.NewReader(data)}
+	if err := lr.decompress("br"); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/bmeg/grip/gripql"
+)
+
+// gidLookupBatch is the number of gids looked up per traversal
+const gidLookupBatch = 1000
+
+// fetchVertices looks up vertices by gid, gidLookupBatch gids per traversal, and returns
+// the ones found in the graph by gid
+func fetchVertices(ctx context.Context, client gripql.Client, graph string, gids []string) (map[string]*gripql.Vertex, error) {
+	found := map[string]*gripql.Vertex{}
+	err := traverseGids(ctx, client, graph, gripql.V, gids, func(r *gripql.QueryResult) {
+		if v := r.GetVertex(); v != nil {
+			found[v.Gid] = v
+		}
+	})
+	return found, err
+}
+
+// fetchEdges looks up edges by gid, gidLookupBatch gids per traversal, and returns
+// the ones found in the graph by gid
+func fetchEdges(ctx context.Context, client gripql.Client, graph string, gids []string) (map[string]*gripql.Edge, error) {
+	found := map[string]*gripql.Edge{}
+	err := traverseGids(ctx, client, graph, gripql.E, gids, func(r *gripql.QueryResult) {
+		if e := r.GetEdge(); e != nil {
+			found[e.Gid] = e
+		}
+	})
+	return found, err
+}
+
+// traverseGids runs the start step over the distinct, non empty gids in batches and passes each result to fn.
+// The results are read from the query stream rather than client.Traversal, which drops the errors of a
+// stream that fails part way, so a backend failure is returned instead of looking like missing gids
+func traverseGids(ctx context.Context, client gripql.Client, graph string, start func(ids ...string) *gripql.Query, gids []string, fn func(*gripql.QueryResult)) error {
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, gid := range gids {
+		if gid != "" && !seen[gid] {
+			seen[gid] = true
+			ids = append(ids, gid)
+		}
+	}
+	for len(ids) > 0 {
+		n := min(len(ids), gidLookupBatch)
+		q := start(ids[:n]...)
+		ids = ids[n:]
+		stream, err := client.QueryC.Traversal(ctx, &gripql.GraphQuery{Graph: graph, Query: q.Statements})
+		if err != nil {
+			return err
+		}
+		for {
+			r, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fn(r)
+		}
+	}
+	return nil
+}
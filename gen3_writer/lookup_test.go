@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingQuery is a grip query service whose traversal streams fail before their first result
+type failingQuery struct {
+	gripql.QueryClient
+}
+
+func (failingQuery) Traversal(ctx context.Context, in *gripql.GraphQuery, opts ...grpc.CallOption) (gripql.Query_TraversalClient, error) {
+	return failingStream{}, nil
+}
+
+type failingStream struct {
+	grpc.ClientStream
+}
+
+func (failingStream) Recv() (*gripql.QueryResult, error) {
+	return nil, status.Error(codes.Unavailable, "backend unavailable")
+}
+
+func Test_LookupStreamError(t *testing.T) {
+	client := gripql.Client{QueryC: failingQuery{}}
+	v := &gripql.Vertex{Gid: "p1", Label: "Patient"}
+
+	// a failed lookup must not pass for an element that isn't stored yet
+	if _, err := fetchStored(context.Background(), client, "test", []*gripql.GraphElement{{Vertex: v}}); err == nil {
+		t.Errorf("expected the stream error to be returned")
+	}
+
+	report := NewLoadReport(0)
+	in := make(chan elementLine, 1)
+	in <- elementLine{line: 1, elem: &gripql.GraphElement{Vertex: v}}
+	close(in)
+	for e := range ownedElements(client, "test", []string{"*"}, in, report) {
+		t.Errorf("expected no element to be passed on, got line %d", e.line)
+	}
+	if report.StatusCode() != http.StatusInternalServerError {
+		t.Errorf("expected the load to fail with 500, got %d", report.StatusCode())
+	}
+
+	report = NewLoadReport(0)
+	dry := newDryRun(client, "test", report)
+	dry.AddVertex("p1", "Patient")
+	dry.Finish()
+	if report.StatusCode() != http.StatusInternalServerError {
+		t.Errorf("expected the dry run to fail with 500, got %d", report.StatusCode())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxReportedRejects is the number of rejected lines that are kept in a load report.
+// Rejects past this are still counted
+const maxReportedRejects = 100
+
+// LineError is a single rejected line of a bulk load
+type LineError struct {
+	Line       int         `json:"line"`
+	Gid        string      `json:"gid,omitempty"`
+	Error      string      `json:"error"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// LoadSummary is the serializable outcome of a bulk load
+type LoadSummary struct {
+	JobID    string      `json:"job_id,omitempty"`
+	Loaded   int64       `json:"loaded"`
+	Rejected int64       `json:"rejected"`
+	Rejects  []LineError `json:"rejects"`
+	Aborted  bool        `json:"aborted"`
+	Error    string      `json:"error,omitempty"`
+	// Encoding is the compression of the upload and DecompressedBytes the size of the NDJSON read from it
+	Encoding          string `json:"encoding,omitempty"`
+	DecompressedBytes int64  `json:"decompressed_bytes"`
+	// DryRun is set when the load was run with dry_run, in which case nothing was written
+	DryRun *DryRunSummary `json:"dry_run,omitempty"`
+}
+
+// LoadReport collects the outcome of a bulk load. It is shared by the reader, the
+// parse workers and the writer so all of its methods are safe for concurrent use.
+type LoadReport struct {
+	mu        sync.Mutex
+	maxErrors int
+	done      chan struct{}
+	once      sync.Once
+	status    int
+	counter   *countingReader
+	summary   LoadSummary
+}
+
+// NewLoadReport creates a report. If maxErrors is > 0 the load is aborted once
+// more than maxErrors lines have been rejected
+func NewLoadReport(maxErrors int) *LoadReport {
+	return &LoadReport{
+		maxErrors: maxErrors,
+		done:      make(chan struct{}),
+		summary:   LoadSummary{Rejects: []LineError{}},
+	}
+}
+
+// SetSource records the compression of the upload and the reader counting its decompressed bytes
+func (lr *LoadReport) SetSource(encoding string, counter *countingReader) {
+	lr.mu.Lock()
+	lr.summary.Encoding = encoding
+	lr.counter = counter
+	lr.mu.Unlock()
+}
+
+// SetJobID records the id of the job running the load
+func (lr *LoadReport) SetJobID(id string) {
+	lr.mu.Lock()
+	lr.summary.JobID = id
+	lr.mu.Unlock()
+}
+
+// SetDryRun records the outcome of a dry run
+func (lr *LoadReport) SetDryRun(summary DryRunSummary) {
+	lr.mu.Lock()
+	lr.summary.DryRun = &summary
+	lr.mu.Unlock()
+}
+
+// Done is closed when the load has been aborted
+func (lr *LoadReport) Done() <-chan struct{} {
+	return lr.done
+}
+
+// AddLoaded records that n elements were handed to the backend
+func (lr *LoadReport) AddLoaded(n int64) {
+	lr.mu.Lock()
+	lr.summary.Loaded += n
+	lr.mu.Unlock()
+}
+
+// Reject records a line that could not be loaded
+func (lr *LoadReport) Reject(line int, gid string, err error) {
+	lr.mu.Lock()
+	lr.summary.Rejected++
+	if len(lr.summary.Rejects) < maxReportedRejects {
+		lr.summary.Rejects = append(lr.summary.Rejects, LineError{Line: line, Gid: gid, Error: err.Error(), Violations: violations(err)})
+	}
+	exceeded := lr.maxErrors > 0 && lr.summary.Rejected > int64(lr.maxErrors)
+	lr.mu.Unlock()
+	if exceeded {
+		lr.Abort(fmt.Errorf("aborted after exceeding max_errors=%d rejected lines", lr.maxErrors))
+	}
+}
+
+// RejectCheck records a line that failed its checks. A check that couldn't read the graph says
+// nothing about the line, so it fails the load instead
+func (lr *LoadReport) RejectCheck(line int, gid string, err error) {
+	if isLookupError(err) {
+		lr.Fail(fmt.Errorf("line %d: %s", line, err))
+		return
+	}
+	lr.Reject(line, gid, err)
+}
+
+// Abort stops the load because of the uploaded data. Only the first reason is kept
+func (lr *LoadReport) Abort(err error) {
+	lr.abort(err, http.StatusUnprocessableEntity)
+}
+
+// Fail stops the load because of a server side error, such as a failed write
+func (lr *LoadReport) Fail(err error) {
+	lr.abort(err, http.StatusInternalServerError)
+}
+
+func (lr *LoadReport) abort(err error, status int) {
+	lr.once.Do(func() {
+		lr.mu.Lock()
+		lr.status = status
+		lr.summary.Aborted = true
+		lr.summary.Error = err.Error()
+		lr.mu.Unlock()
+		close(lr.done)
+	})
+}
+
+// IsAborted reports whether Abort has been called
+func (lr *LoadReport) IsAborted() bool {
+	select {
+	case <-lr.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// StatusCode is the HTTP status of the load
+func (lr *LoadReport) StatusCode() int {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.status == 0 {
+		return http.StatusOK
+	}
+	return lr.status
+}
+
+// Summary returns a copy of the report that is safe to serialize while the load is running
+func (lr *LoadReport) Summary() LoadSummary {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	out := lr.summary
+	if lr.counter != nil {
+		out.DecompressedBytes = lr.counter.Count()
+	}
+	out.Rejects = make([]LineError, len(lr.summary.Rejects))
+	copy(out.Rejects, lr.summary.Rejects)
+	return out
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_ProcessReaderLineNumbers(t *testing.T) {
+	report := NewLoadReport(0)
+	lines, err := processReader(strings.NewReader("{\"gid\": \"a\"}\n\n{\"gid\": \"b\"}\n"), 1, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nums := []int{}
+	for l := range lines {
+		nums = append(nums, l.num)
+	}
+	if fmt.Sprint(nums) != "[1 3]" {
+		t.Errorf("unexpected line numbers %v", nums)
+	}
+}
+
+func Test_LoadReportMaxErrors(t *testing.T) {
+	report := NewLoadReport(2)
+	for i := 1; i <= 2; i++ {
+		report.Reject(i, "", fmt.Errorf("bad line"))
+	}
+	if report.IsAborted() {
+		t.Error("load aborted before max_errors was exceeded")
+	}
+	report.Reject(3, "", fmt.Errorf("bad line"))
+	if !report.IsAborted() {
+		t.Error("load not aborted after max_errors was exceeded")
+	}
+	summary := report.Summary()
+	if summary.Rejected != 3 || len(summary.Rejects) != 3 || summary.Rejects[2].Line != 3 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if report.StatusCode() != 422 {
+		t.Errorf("unexpected status %d", report.StatusCode())
+	}
+}
+
+func Test_LoadReportRejectsBounded(t *testing.T) {
+	report := NewLoadReport(0)
+	for i := 0; i < maxReportedRejects+10; i++ {
+		report.Reject(i, "", fmt.Errorf("bad line"))
+	}
+	summary := report.Summary()
+	if len(summary.Rejects) != maxReportedRejects || summary.Rejected != maxReportedRejects+10 {
+		t.Errorf("unexpected summary counts %d %d", len(summary.Rejects), summary.Rejected)
+	}
+}
+
+func Test_LoadReportRejectCheck(t *testing.T) {
+	report := NewLoadReport(0)
+	report.RejectCheck(1, "e1", fmt.Errorf("edge label 'x' is not declared"))
+	if report.IsAborted() || report.Summary().Rejected != 1 {
+		t.Errorf("expected a failed check to reject the line, got %+v", report.Summary())
+	}
+	report.RejectCheck(2, "e2", fmt.Errorf("edge: %w", &LookupError{Gid: "p1", Err: fmt.Errorf("connection refused")}))
+	if !report.IsAborted() || report.StatusCode() != 500 || report.Summary().Rejected != 1 {
+		t.Errorf("expected a failed lookup to fail the load, got %d %+v", report.StatusCode(), report.Summary())
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bmeg/grip-graphql/middleware"
+	"github.com/bmeg/grip/gripql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxCachedLabels bounds the gid -> label cache used to check edge endpoints
+const maxCachedLabels = 1000000
+
+// elementCheck validates an element before it is written. A non-nil error rejects the element
+type elementCheck func(ge *gripql.GraphElement) error
+
+// runChecks applies each check in order and returns the first failure
+func runChecks(checks []elementCheck, ge *gripql.GraphElement) error {
+	for _, check := range checks {
+		if err := check(ge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elementGid returns the gid of the vertex or edge in a GraphElement
+func elementGid(ge *gripql.GraphElement) string {
+	if ge.Vertex != nil {
+		return ge.Vertex.Gid
+	}
+	if ge.Edge != nil {
+		return ge.Edge.Gid
+	}
+	return ""
+}
+
+// LookupError is a failure to read the graph while checking an element. Unlike a failed
+// check it says nothing about the element, so it is reported as a server error
+type LookupError struct {
+	Gid string
+	Err error
+}
+
+func (le *LookupError) Error() string {
+	return fmt.Sprintf("failed to look up %s: %s", le.Gid, le.Err)
+}
+
+func (le *LookupError) Unwrap() error {
+	return le.Err
+}
+
+// isLookupError reports whether a check failed because the graph could not be read
+func isLookupError(err error) bool {
+	le := &LookupError{}
+	return errors.As(err, &le)
+}
+
+func isTrue(s string) bool {
+	s = strings.ToLower(s)
+	return s == "true" || s == "1" || s == "yes"
+}
+
+// SchemaValidator checks elements against the grip schema of a graph: vertex and edge
+// labels must be declared, properties must have the declared type, and edges must connect
+// a declared pair of vertex labels.
+type SchemaValidator struct {
+	client     gripql.Client
+	graph      string
+	vertices   map[string]map[string]any
+	edges      map[string]map[[2]string]bool
+	edgeFields map[string]map[string]any
+
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+// schemaValidator returns a validator for the graph if schema validation was requested with
+// the validate_schema option or enabled for all writes with the validate_schema config key
+func (gh *Handler) schemaValidator(graph string, option string) (*SchemaValidator, error) {
+	if !isTrue(option) && !isTrue(gh.config["validate_schema"]) {
+		return nil, nil
+	}
+	schema, err := gh.client.GetSchema(graph)
+	if err != nil || schema == nil {
+		return nil, &middleware.ServerError{StatusCode: http.StatusUnprocessableEntity, Message: fmt.Sprintf("schema validation requested but no schema could be loaded for graph %s: %v", graph, err)}
+	}
+	return NewSchemaValidator(gh.client, graph, schema), nil
+}
+
+// NewSchemaValidator indexes a grip schema, as posted with add-schema, for validation
+func NewSchemaValidator(client gripql.Client, graph string, schema *gripql.Graph) *SchemaValidator {
+	sv := &SchemaValidator{
+		client:     client,
+		graph:      graph,
+		vertices:   map[string]map[string]any{},
+		edges:      map[string]map[[2]string]bool{},
+		edgeFields: map[string]map[string]any{},
+		labels:     map[string]string{},
+	}
+	for _, v := range schema.Vertices {
+		props := v.GetDataMap()
+		if props == nil {
+			props = map[string]any{}
+		}
+		sv.vertices[v.Gid] = props
+	}
+	for _, e := range schema.Edges {
+		if _, ok := sv.edges[e.Label]; !ok {
+			sv.edges[e.Label] = map[[2]string]bool{}
+		}
+		sv.edges[e.Label][[2]string{e.From, e.To}] = true
+		if props := e.GetDataMap(); len(props) > 0 {
+			sv.edgeFields[e.Label] = props
+		}
+	}
+	return sv
+}
+
+// Check validates a vertex or edge. It has the signature of an elementCheck
+func (sv *SchemaValidator) Check(ge *gripql.GraphElement) error {
+	if ge.Vertex != nil {
+		return sv.ValidateVertex(ge.Vertex)
+	}
+	if ge.Edge != nil {
+		return sv.ValidateEdge(ge.Edge)
+	}
+	return fmt.Errorf("element has neither a vertex nor an edge")
+}
+
+func (sv *SchemaValidator) ValidateVertex(v *gripql.Vertex) error {
+	props, ok := sv.vertices[v.Label]
+	if !ok {
+		return fmt.Errorf("vertex label '%s' is not declared in the schema of graph %s", v.Label, sv.graph)
+	}
+	if err := checkProperties(v.Label, props, v.GetDataMap()); err != nil {
+		return err
+	}
+	sv.rememberLabel(v.Gid, v.Label)
+	return nil
+}
+
+func (sv *SchemaValidator) ValidateEdge(e *gripql.Edge) error {
+	pairs, ok := sv.edges[e.Label]
+	if !ok {
+		return fmt.Errorf("edge label '%s' is not declared in the schema of graph %s", e.Label, sv.graph)
+	}
+	if props, ok := sv.edgeFields[e.Label]; ok {
+		if err := checkProperties(e.Label, props, e.GetDataMap()); err != nil {
+			return err
+		}
+	}
+	// Endpoints that are not in the graph yet (e.g. loaded later in the same file)
+	// can't be checked, only the edge label is validated for them
+	fromLabel, fromOk, err := sv.lookupLabel(e.From)
+	if err != nil {
+		return err
+	}
+	toLabel, toOk, err := sv.lookupLabel(e.To)
+	if err != nil {
+		return err
+	}
+	if fromOk && toOk && !pairs[[2]string{fromLabel, toLabel}] {
+		allowed := []string{}
+		for p := range pairs {
+			allowed = append(allowed, fmt.Sprintf("%s->%s", p[0], p[1]))
+		}
+		sort.Strings(allowed)
+		return fmt.Errorf("edge '%s' from %s to %s is not declared in the schema, allowed: %s", e.Label, fromLabel, toLabel, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+func (sv *SchemaValidator) rememberLabel(gid string, label string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if len(sv.labels) < maxCachedLabels {
+		sv.labels[gid] = label
+	}
+}
+
+// lookupLabel finds the label of a vertex, first in the vertices already validated
+// and then in the graph. A vertex that isn't found is not an error, any other failure is
+func (sv *SchemaValidator) lookupLabel(gid string) (string, bool, error) {
+	sv.mu.Lock()
+	label, ok := sv.labels[gid]
+	sv.mu.Unlock()
+	if ok {
+		return label, true, nil
+	}
+	v, err := sv.client.GetVertex(sv.graph, gid)
+	if status.Code(err) == codes.NotFound || (err == nil && v == nil) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, &LookupError{Gid: gid, Err: err}
+	}
+	sv.rememberLabel(gid, v.Label)
+	return v.Label, true, nil
+}
+
+// checkProperties validates the properties of an element against the schema field types
+func checkProperties(path string, schema map[string]any, data map[string]any) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t, ok := schema[k]
+		if !ok {
+			return fmt.Errorf("property '%s.%s' is not declared in the schema", path, k)
+		}
+		if err := checkType(path+"."+k, t, data[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkType validates a value against a schema type, which is one of the type names
+// NUMERIC, STRING, BOOL or STRLIST, a map of nested fields, or a list holding the element type
+func checkType(path string, schemaType any, value any) error {
+	if value == nil {
+		return nil
+	}
+	switch t := schemaType.(type) {
+	case string:
+		ok := true
+		switch t {
+		case "NUMERIC":
+			_, ok = value.(float64)
+		case "STRING":
+			_, ok = value.(string)
+		case "BOOL":
+			_, ok = value.(bool)
+		case "STRLIST":
+			if l, isList := value.([]any); isList {
+				for _, i := range l {
+					if _, isStr := i.(string); !isStr {
+						ok = false
+					}
+				}
+			} else {
+				ok = false
+			}
+		}
+		if !ok {
+			return fmt.Errorf("property '%s' must be %s, got %T", path, t, value)
+		}
+	case map[string]any:
+		m, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("property '%s' must be an object, got %T", path, value)
+		}
+		return checkProperties(path, t, m)
+	case []any:
+		l, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("property '%s' must be a list, got %T", path, value)
+		}
+		if len(t) == 0 {
+			return nil
+		}
+		for i, v := range l {
+			if err := checkType(fmt.Sprintf("%s[%d]", path, i), t[0], v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_SchemaCheckProperties(t *testing.T) {
+	schema := map[string]any{
+		"birthDate": "STRING",
+		"age":       "NUMERIC",
+		"deceased":  "BOOL",
+		"tags":      "STRLIST",
+		"code":      map[string]any{"text": "STRING"},
+		"identifier": []any{
+			map[string]any{"value": "STRING"},
+		},
+	}
+	tests := []struct {
+		name string
+		data map[string]any
+		ok   bool
+	}{
+		{name: "conforming", data: map[string]any{"birthDate": "1913-10-29", "age": 66.0, "deceased": false, "tags": []any{"a"}, "code": map[string]any{"text": "x"}, "identifier": []any{map[string]any{"value": "1"}}}, ok: true},
+		{name: "null value", data: map[string]any{"age": nil}, ok: true},
+		{name: "string for numeric", data: map[string]any{"age": "66"}, ok: false},
+		{name: "undeclared property", data: map[string]any{"color": "red"}, ok: false},
+		{name: "nested wrong type", data: map[string]any{"code": map[string]any{"text": 1.0}}, ok: false},
+		{name: "list element wrong type", data: map[string]any{"identifier": []any{map[string]any{"value": true}}}, ok: false},
+		{name: "strlist with number", data: map[string]any{"tags": []any{"a", 1.0}}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkProperties("Patient", schema, tt.data)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
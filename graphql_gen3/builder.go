@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
 	"google.golang.org/protobuf/encoding/protojson"
 
+	"github.com/bmeg/grip-endpoints/authz"
 	"github.com/bmeg/grip/gripql"
 	"github.com/bmeg/grip/log"
 	"github.com/graphql-go/graphql"
@@ -24,6 +27,7 @@ const ARG_IDS = "ids"
 const ARG_FILTER = "filter"
 const ARG_ACCESS = "accessibility"
 const ARG_SORT = "sort"
+const ARG_AFTER = "after"
 
 type Accessibility string
 
@@ -33,33 +37,139 @@ const (
 	unaccessible Accessibility = "unaccessible"
 )
 
+// AccessibilityEnum is the Guppy tiered access argument. Aggregations count the user's
+// resources (accessible), the other resources (unaccessible) or everything (all), the latter
+// two only if a tier access limit is configured. Records are always limited to the user's resources
+var AccessibilityEnum = graphql.NewEnum(graphql.EnumConfig{
+	Name: "Accessibility",
+	Values: graphql.EnumValueConfigMap{
+		string(all):          &graphql.EnumValueConfig{Value: all},
+		string(accessible):   &graphql.EnumValueConfig{Value: accessible},
+		string(unaccessible): &graphql.EnumValueConfig{Value: unaccessible},
+	},
+})
+
+// accessibilityArg returns the accessibility argument of a query, all if it is not set
+func accessibilityArg(args map[string]any) (Accessibility, error) {
+	switch v := args[ARG_ACCESS].(type) {
+	case nil:
+		return all, nil
+	case Accessibility:
+		return v, nil
+	case string:
+		switch a := Accessibility(v); a {
+		case all, accessible, unaccessible:
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("accessibility must be one of all, accessible or unaccessible, got %v", args[ARG_ACCESS])
+}
+
+// parseTierAccessLimit reads the tier_access_limit entry of the plugin config, the smallest count
+// _aggregation reports beyond the user's resources. Without it only accessible counts are served
+func parseTierAccessLimit(config map[string]string) (int, error) {
+	v, ok := config["tier_access_limit"]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("tier_access_limit must be a positive integer, got '%s'", v)
+	}
+	return n, nil
+}
+
+// minBucketCount returns the smallest count an aggregation may report for the accessibility:
+// counts reaching beyond the user's resources are hidden below the tier access limit, so the
+// records of other projects can't be singled out. Those counts are refused if no limit is set
+func minBucketCount(access Accessibility, resourceList []any, tierAccessLimit int) (int, error) {
+	if access == accessible {
+		return 0, nil
+	}
+	for _, r := range resourceList {
+		if r == authz.AllResources {
+			return 0, nil
+		}
+	}
+	if tierAccessLimit == 0 {
+		return 0, fmt.Errorf("accessibility %s is not enabled, set tier_access_limit in the plugin config", access)
+	}
+	return tierAccessLimit, nil
+}
+
+// tierCount reports a total below the minimum count as 0
+func tierCount(count int, minCount int) int {
+	if count < minCount {
+		return 0
+	}
+	return count
+}
+
+// nonFacetFields are identifiers rather than categories. Beyond the user's resources their
+// buckets would name other projects' records one by one, so they are left empty there
+var nonFacetFields = map[string]bool{"id": true, "auth_resource_path": true}
+
+// facetCounted reports whether the buckets of a field are counted, given the minimum count of the accessibility
+func facetCounted(field string, minCount int) bool {
+	return minCount == 0 || !nonFacetFields[field]
+}
+
+// JSONScalar is an arbitrary JSON value, used by the filter and sort arguments and for unstructured
+// data fields. Values are passed through on output, and inline literals are converted the same way
+// encoding/json decodes variables, so a filter behaves the same whichever way it is written
 var JSONScalar = graphql.NewScalar(graphql.ScalarConfig{
 	Name: "JSON",
 	Serialize: func(value interface{}) interface{} {
-		return fmt.Sprintf("Serialize %v", value)
+		return value
 	},
 	ParseValue: func(value interface{}) interface{} {
-		//fmt.Printf("Unmarshal JSON: %v %T\n", value, value)
 		return value
 	},
 	ParseLiteral: func(valueAST ast.Value) interface{} {
-		fmt.Printf("ParseLiteral: %#v\n", valueAST)
-		/*
-			switch valueAST := valueAST.(type) {
-			case *ast.StringValue:
-				id, _ := models.IDFromString(valueAST.Value)
-				return id
-			default:
-				return nil
-			}*/
-		return nil
+		return parseJSONLiteral(valueAST)
 	},
 })
 
+// parseJSONLiteral converts a GraphQL literal to the Go value encoding/json would decode from the
+// equivalent JSON: objects to map[string]any, lists to []any and numbers to float64.
+// Variables can't be resolved inside a literal and are nil
+func parseJSONLiteral(valueAST ast.Value) interface{} {
+	switch v := valueAST.(type) {
+	case *ast.ObjectValue:
+		out := map[string]any{}
+		for _, f := range v.Fields {
+			out[f.Name.Value] = parseJSONLiteral(f.Value)
+		}
+		return out
+	case *ast.ListValue:
+		out := make([]any, 0, len(v.Values))
+		for _, i := range v.Values {
+			out = append(out, parseJSONLiteral(i))
+		}
+		return out
+	case *ast.StringValue:
+		return v.Value
+	case *ast.IntValue, *ast.FloatValue:
+		f, err := strconv.ParseFloat(v.GetValue().(string), 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.EnumValue:
+		if v.Value == "null" {
+			return nil
+		}
+		return v.Value
+	}
+	return nil
+}
+
 // buildGraphQLSchema reads a GRIP graph schema (which is stored as a graph) and creates
 // a GraphQL-GO based schema. The GraphQL-GO schema all wraps the request functions that use
 // the gripql.Client to find the requested data
-func buildGraphQLSchema(schema *gripql.Graph, client gripql.Client, graph string, resourceList []any) (*graphql.Schema, error) {
+func buildGraphQLSchema(schema *gripql.Graph, client gripql.Client, graph string, resourceList []any, tierAccessLimit int) (*graphql.Schema, error) {
 	if schema == nil {
 		return nil, fmt.Errorf("graphql.NewSchema error: nil gripql.Graph for graph: %s", graph)
 	}
@@ -71,7 +181,7 @@ func buildGraphQLSchema(schema *gripql.Graph, client gripql.Client, graph string
 	}
 
 	// Build the set of objects that exist in the query structuer
-	queryObj := buildQueryObject(client, graph, objectMap, resourceList)
+	queryObj := buildQueryObject(client, graph, objectMap, resourceList, tierAccessLimit)
 	schemaConfig := graphql.SchemaConfig{
 		Query: queryObj,
 	}
@@ -194,6 +304,26 @@ type objectMap struct {
 	objects     map[string]*graphql.Object
 	edgeLabel   map[string]map[string]string
 	edgeDstType map[string]map[string]string
+	// fieldTypes are the schema types (NUMERIC, STRING, BOOL) of the scalar and list fields of each object
+	fieldTypes map[string]map[string]string
+}
+
+// schemaFieldTypes returns the types of the scalar fields of a schema vertex, and the element
+// type of its list fields. STRLIST fields hold strings
+func schemaFieldTypes(props map[string]any) map[string]string {
+	out := map[string]string{}
+	for k, v := range props {
+		if l, ok := v.([]any); ok && len(l) > 0 {
+			v = l[0]
+		}
+		if t, ok := v.(string); ok {
+			if t == "STRLIST" {
+				t = "STRING"
+			}
+			out[k] = t
+		}
+	}
+	return out
 }
 
 // buildObjectMap scans the GripQL schema and turns all of the vertex types into different objects
@@ -201,6 +331,7 @@ func buildObjectMap(client gripql.Client, graph string, schema *gripql.Graph) (*
 	objects := map[string]*graphql.Object{}
 	edgeLabel := map[string]map[string]string{}
 	edgeDstType := map[string]map[string]string{}
+	fieldTypes := map[string]map[string]string{}
 
 	for _, obj := range schema.Vertices {
 		if obj.Label == "Vertex" {
@@ -217,6 +348,7 @@ func buildObjectMap(client gripql.Client, graph string, schema *gripql.Graph) (*
 			}
 			if len(gqlObj.Fields()) > 0 {
 				objects[obj.Gid] = gqlObj
+				fieldTypes[obj.Gid] = schemaFieldTypes(props)
 			}
 		}
 		edgeLabel[obj.Gid] = map[string]string{}
@@ -282,7 +414,7 @@ func buildObjectMap(client gripql.Client, graph string, schema *gripql.Graph) (*
 		}
 	}
 
-	return &objectMap{objects: objects, edgeLabel: edgeLabel, edgeDstType: edgeDstType}, nil
+	return &objectMap{objects: objects, edgeLabel: edgeLabel, edgeDstType: edgeDstType, fieldTypes: fieldTypes}, nil
 }
 
 func buildFieldConfigArgument(obj *graphql.Object) graphql.FieldConfigArgument {
@@ -292,7 +424,7 @@ func buildFieldConfigArgument(obj *graphql.Object) graphql.FieldConfigArgument {
 		ARG_LIMIT:  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100},
 		ARG_OFFSET: &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
 		ARG_FILTER: &graphql.ArgumentConfig{Type: JSONScalar},
-		ARG_ACCESS: &graphql.ArgumentConfig{Type: graphql.EnumValueType, DefaultValue: all},
+		ARG_ACCESS: &graphql.ArgumentConfig{Type: AccessibilityEnum, DefaultValue: all},
 		ARG_SORT:   &graphql.ArgumentConfig{Type: JSONScalar},
 	}
 	if obj == nil {
@@ -351,7 +483,7 @@ func buildMappingField(client gripql.Client, graph string, objects *objectMap) *
 	}
 }
 
-func buildAggregationField(client gripql.Client, graph string, objects *objectMap, resourceList []any) *graphql.Field {
+func buildAggregationField(client gripql.Client, graph string, objects *objectMap, resourceList []any, tierAccessLimit int) *graphql.Field {
 	stringBucket := graphql.NewObject(graphql.ObjectConfig{
 		Name: "BucketsForString",
 		Fields: graphql.Fields{
@@ -426,11 +558,19 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 				Type: ao,
 				Args: graphql.FieldConfigArgument{
 					"filter":        &graphql.ArgumentConfig{Type: JSONScalar},
-					"accessibility": &graphql.ArgumentConfig{Type: graphql.EnumValueType, DefaultValue: all},
+					"accessibility": &graphql.ArgumentConfig{Type: AccessibilityEnum, DefaultValue: accessible},
 					"filterSelf":    &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					T_0 := time.Now()
+					access, err := accessibilityArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					minCount, err := minBucketCount(access, resourceList, tierAccessLimit)
+					if err != nil {
+						return nil, err
+					}
 					aggs := []*gripql.Aggregate{
 						{Name: "_totalCount", Aggregation: &gripql.Aggregate_Count{}},
 					}
@@ -440,7 +580,9 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 						if i.SelectionSet != nil {
 							for _, j := range i.SelectionSet.Selections {
 								if k, ok := j.(*ast.Field); ok {
-									if k.Name.Value != "_totalCount" {
+									if !facetCounted(k.Name.Value, minCount) {
+										counts[k.Name.Value] = []any{}
+									} else if k.Name.Value != "_totalCount" && !strings.HasPrefix(k.Name.Value, "__") {
 										aggs = append(aggs, &gripql.Aggregate{
 											Name: k.Name.Value,
 											Aggregation: &gripql.Aggregate_Term{
@@ -457,24 +599,24 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 					}
 
 					queries := []any{}
-					if filterSelf, ok := p.Args["filterSelf"].(bool); ok {
-						if !filterSelf && p.Args[ARG_FILTER] != nil {
-
-							var err error
-							var filter *FilterBuilder
-							if filterArg, ok := p.Args[ARG_FILTER].(map[string]any); ok {
-								fmt.Printf("Filter: %#v\n", filterArg)
-								filter = NewFilterBuilder(filterArg)
+					filter, err := filterArg(p.Args, objects, k, resourceList)
+					if err != nil {
+						return nil, err
+					}
+					if filter != nil {
+						// with filterSelf each aggregated field is also filtered on its own conditions,
+						// otherwise they are left out so the other values of the field still show
+						filterSelf, _ := p.Args["filterSelf"].(bool)
+						for _, val := range aggs {
+							skip := val.Name
+							if filterSelf {
+								skip = ""
 							}
-							for _, val := range aggs {
-								q := gripql.V().HasLabel(label).Has(gripql.Within("auth_resource_path", resourceList...))
-								q, err = filter.ExtendGrip(q, val.Name)
-								queries = append(queries, q)
-								if err != nil {
-									return nil, err
-								}
+							q, err := filter.ExtendGrip(accessibleVertices(label, resourceList, access), skip)
+							if err != nil {
+								return nil, err
 							}
-
+							queries = append(queries, q)
 						}
 					}
 					//fmt.Println("VALUE OF Q: ", q, "VALUE OF STATEMENTS: ", q.Statements)
@@ -502,9 +644,9 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 							for i := range result {
 								agg := i.GetAggregations()
 								if agg.Name == "_totalCount" {
-									out["_totalCount"] = int(agg.Value)
+									out["_totalCount"] = tierCount(int(agg.Value), minCount)
 
-								} else {
+								} else if int(agg.Value) >= minCount {
 									marshal, _ := protojson.Marshal(agg)
 									var unmarhsal map[string]any
 									json.Unmarshal(marshal, &unmarhsal)
@@ -585,7 +727,7 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 						}
 						// this else is needed to differentiate filtered aggregations and non filtered aggregations
 					} else {
-						q := gripql.V().HasLabel(label).Has(gripql.Within("auth_resource_path", resourceList...))
+						q := accessibleVertices(label, resourceList, access)
 						q = q.Aggregate(aggs)
 						result, err := client.Traversal(p.Context, &gripql.GraphQuery{Graph: graph, Query: q.Statements})
 						if err != nil {
@@ -595,8 +737,8 @@ func buildAggregationField(client gripql.Client, graph string, objects *objectMa
 						for i := range result {
 							agg := i.GetAggregations()
 							if agg.Name == "_totalCount" {
-								out["_totalCount"] = int(agg.Value)
-							} else {
+								out["_totalCount"] = tierCount(int(agg.Value), minCount)
+							} else if int(agg.Value) >= minCount {
 								marshal, _ := protojson.Marshal(agg)
 								var unmarhsal map[string]any
 								json.Unmarshal(marshal, &unmarhsal)
@@ -686,8 +828,11 @@ func (om *objectMap) traversalBuild(query *gripql.Query, vertLabel string, field
 					query = query.OutNull(k.Name.Value).As(rName)
 
 					// Additionally have to control the number of outputs on the results of each traversal
-					// otherwise there are instances when you get all of the results for each traversal node
-					query = query.Skip(uint32(offset)).Limit(uint32(limit))
+					// otherwise there are instances when you get all of the results for each traversal node.
+					// A negative limit leaves the traversal unpaged
+					if limit >= 0 {
+						query = query.Skip(uint32(offset)).Limit(uint32(limit))
+					}
 					query = om.traversalBuild(query, dstLabel, k, rName, rt, limit, offset)
 					moved = true
 				}
@@ -697,12 +842,154 @@ func (om *objectMap) traversalBuild(query *gripql.Query, vertLabel string, field
 	return query
 }
 
+// authorizedVertices starts a query on the vertices of a label that are in the user's resources
+func authorizedVertices(label string, resourceList []any) *gripql.Query {
+	return accessFilter(gripql.V().HasLabel(label), resourceList, accessible)
+}
+
+// accessibleVertices starts an aggregation query on the vertices of a label selected by the accessibility
+func accessibleVertices(label string, resourceList []any, access Accessibility) *gripql.Query {
+	return accessFilter(gripql.V().HasLabel(label), resourceList, access)
+}
+
+// accessFilter limits a query to the vertices inside (accessible) or outside (unaccessible) the
+// user's resources. all leaves the query as is, so it must only be used for aggregate counts
+func accessFilter(q *gripql.Query, resourceList []any, access Accessibility) *gripql.Query {
+	if access == all {
+		return q
+	}
+	everything := false
+	for _, r := range resourceList {
+		if r == authz.AllResources {
+			everything = true
+		}
+	}
+	switch {
+	case access == unaccessible && everything:
+		// nothing is out of reach of a user holding every resource
+		return q.Has(gripql.Within("auth_resource_path"))
+	case access == unaccessible:
+		return q.Has(gripql.Without("auth_resource_path", resourceList...))
+	case everything:
+		return q
+	}
+	return q.Has(gripql.Within("auth_resource_path", resourceList...))
+}
+
+// typeQuery starts the query of a type query: the user's vertices of the label, narrowed down by
+// the id, ids, field and filter arguments
+func (om *objectMap) typeQuery(args map[string]any, objName string, label string, resourceList []any) (*gripql.Query, error) {
+	// records are limited to the user's resources whatever the accessibility,
+	// the other tiers can only be counted through _aggregation
+	access, err := accessibilityArg(args)
+	if err != nil {
+		return nil, err
+	}
+	if access == unaccessible {
+		return nil, fmt.Errorf("accessibility %s is only supported by _aggregation, %s records are limited to accessible ones", unaccessible, objName)
+	}
+
+	q := authorizedVertices(label, resourceList)
+	if id, ok := args[ARG_ID].(string); ok {
+		fmt.Printf("Doing %s id=%s query", label, id)
+		q = accessFilter(gripql.V(id).HasLabel(label), resourceList, accessible)
+	}
+	if ids, ok := args[ARG_IDS].([]string); ok {
+		fmt.Printf("Doing %s ids=%s queries", label, ids)
+		q = accessFilter(gripql.V(ids...).HasLabel(label), resourceList, accessible)
+	}
+	filter, err := filterArg(args, om, objName, resourceList)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range args {
+		switch key {
+		case ARG_ID, ARG_IDS, ARG_LIMIT, ARG_OFFSET, ARG_ACCESS, ARG_SORT, ARG_FILTER, ARG_AFTER:
+		default:
+			q = q.Has(gripql.Eq(key, val))
+		}
+	}
+
+	if filter != nil {
+		// extend grip calls the filter functions to add filters
+		q, err = filter.ExtendGrip(q, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// renderRows runs a type query and returns a row per result, holding the root vertex and the
+// edge fields selected by fieldASTs. A negative limit leaves the query unpaged
+func (om *objectMap) renderRows(ctx context.Context, client gripql.Client, graph string, q *gripql.Query, label string, fieldASTs []*ast.Field, limit int, offset int) ([]any, error) {
+	q = q.As("f0")
+	if limit >= 0 {
+		q = q.Skip(uint32(offset)).Limit(uint32(limit))
+	}
+
+	rt := &renderTree{
+		fields:    []string{"f0"},
+		parent:    map[string]string{},
+		fieldName: map[string]string{},
+	}
+	//fmt.Println("Q1: ", q)
+
+	for _, f := range fieldASTs {
+		q = om.traversalBuild(q, label, f, "f0", rt, limit, offset)
+	}
+
+	render := map[string]any{}
+	for _, i := range rt.fields {
+		render[i+"_gid"] = "$" + i + "._gid"
+		render[i+"_data"] = "$" + i + "._data"
+	}
+	q = q.Render(render)
+	result, err := client.Traversal(ctx, &gripql.GraphQuery{Graph: graph, Query: q.Statements})
+	if err != nil {
+		return nil, err
+	}
+
+	out := []any{}
+	for r := range result {
+		values := r.GetRender().GetStructValue().AsMap()
+
+		data := map[string]map[string]any{}
+		for _, r := range rt.fields {
+			v := values[r+"_data"]
+			if d, ok := v.(map[string]any); ok {
+				d["id"] = values[r+"_gid"]
+				if d["id"] != "" {
+					data[r] = d
+				}
+			}
+		}
+		for _, r := range rt.fields {
+			if parent, ok := rt.parent[r]; ok {
+				fieldName := rt.fieldName[r]
+				if data[r] != nil {
+					data[parent][fieldName] = []any{data[r]}
+				}
+			}
+		}
+		out = append(out, data["f0"])
+	}
+	return out, nil
+}
+
 // buildQueryObject scans the built objects, which were derived from the list of vertex types
 // found in the schema. It then build a query object that will take search parameters
 // and create lists of objects of that type
-func buildQueryObject(client gripql.Client, graph string, objects *objectMap, resourceList []any) *graphql.Object {
+func buildQueryObject(client gripql.Client, graph string, objects *objectMap, resourceList []any, tierAccessLimit int) *graphql.Object {
 
 	queryFields := graphql.Fields{}
+	pageInfo := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.Boolean},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
 	// For each of the objects that have been listed in the objectMap build a query entry point
 	for objName, obj := range objects.objects {
 		fmt.Println("UPPER CASE: ", obj.Name())
@@ -712,97 +999,30 @@ func buildQueryObject(client gripql.Client, graph string, objects *objectMap, re
 			Type: graphql.NewList(obj),
 			Args: buildFieldConfigArgument(obj),
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-
-				q := gripql.V().HasLabel(label).Has(gripql.Within("auth_resource_path", resourceList...))
-				if id, ok := params.Args[ARG_ID].(string); ok {
-					fmt.Printf("Doing %s id=%s query", label, id)
-					q = gripql.V(id).HasLabel(label)
-				}
-				if ids, ok := params.Args[ARG_IDS].([]string); ok {
-					fmt.Printf("Doing %s ids=%s queries", label, ids)
-					q = gripql.V(ids...).HasLabel(label)
-				}
-				var filter *FilterBuilder
-				if filterArg, ok := params.Args[ARG_FILTER].(map[string]any); ok {
-					fmt.Printf("Filter: %#v\n", filterArg)
-					filter = NewFilterBuilder(filterArg)
-				}
-				for key, val := range params.Args {
-					switch key {
-					case ARG_ID, ARG_IDS, ARG_LIMIT, ARG_OFFSET, ARG_ACCESS, ARG_SORT, ARG_FILTER:
-					default:
-						q = q.Has(gripql.Eq(key, val))
-					}
-				}
-
-				if filter != nil {
-					var err error
-					// extend grip calls the filter functions to add filters
-					q, err = filter.ExtendGrip(q, "")
-					if err != nil {
-						return nil, err
-					}
+				q, err := objects.typeQuery(params.Args, objName, label, resourceList)
+				if err != nil {
+					return nil, err
 				}
-
-				q = q.As("f0")
 				limit := params.Args[ARG_LIMIT].(int)
 				offset := params.Args[ARG_OFFSET].(int)
-				q = q.Skip(uint32(offset)).Limit(uint32(limit))
-
-				rt := &renderTree{
-					fields:    []string{"f0"},
-					parent:    map[string]string{},
-					fieldName: map[string]string{},
-				}
-				//fmt.Println("Q1: ", q)
-
-				for _, f := range params.Info.FieldASTs {
-					q = objects.traversalBuild(q, label, f, "f0", rt, limit, offset)
-				}
-
-				render := map[string]any{}
-				for _, i := range rt.fields {
-					render[i+"_gid"] = "$" + i + "._gid"
-					render[i+"_data"] = "$" + i + "._data"
-				}
-				q = q.Render(render)
-				result, err := client.Traversal(params.Context, &gripql.GraphQuery{Graph: graph, Query: q.Statements})
+				sortKeys, err := parseSort(params.Args[ARG_SORT], obj)
 				if err != nil {
 					return nil, err
 				}
-
-				out := []any{}
-				for r := range result {
-					values := r.GetRender().GetStructValue().AsMap()
-
-					data := map[string]map[string]any{}
-					for _, r := range rt.fields {
-						v := values[r+"_data"]
-						if d, ok := v.(map[string]any); ok {
-							d["id"] = values[r+"_gid"]
-							if d["id"] != "" {
-								data[r] = d
-							}
-						}
-					}
-					for _, r := range rt.fields {
-						if parent, ok := rt.parent[r]; ok {
-							fieldName := rt.fieldName[r]
-							if data[r] != nil {
-								data[parent][fieldName] = []any{data[r]}
-							}
-						}
-					}
-					out = append(out, data["f0"])
+				if sortKeys != nil {
+					// the sort goes ahead of the page's skip and limit
+					q = sortQuery(q, sortKeys)
 				}
+				out, err := objects.renderRows(params.Context, client, graph, q, label, params.Info.FieldASTs, limit, offset)
 				fmt.Println("OUT: ", out)
-				return out, nil
+				return out, err
 			},
 		}
 		queryFields[objName] = f
+		queryFields[objName+"Connection"] = buildConnectionField(client, graph, objects, objName, pageInfo, resourceList)
 	}
 
-	queryFields["_aggregation"] = buildAggregationField(client, graph, objects, resourceList)
+	queryFields["_aggregation"] = buildAggregationField(client, graph, objects, resourceList, tierAccessLimit)
 	queryFields["_mapping"] = buildMappingField(client, graph, objects)
 
 	query := graphql.NewObject(
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql"
+)
+
+func Test_AccessibilityArg(t *testing.T) {
+	cases := []struct {
+		arg  any
+		want Accessibility
+		err  bool
+	}{
+		{nil, all, false},
+		{accessible, accessible, false},
+		{"unaccessible", unaccessible, false},
+		{"none", "", true},
+		{3, "", true},
+	}
+	for _, c := range cases {
+		got, err := accessibilityArg(map[string]any{ARG_ACCESS: c.arg})
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("%v: expected %q (error %v), got %q (%v)", c.arg, c.want, c.err, got, err)
+		}
+	}
+}
+
+func Test_AccessibilityFilter(t *testing.T) {
+	resources := []any{"/programs/a/projects/b"}
+	everything := []any{"*"}
+	base := func() *gripql.Query { return gripql.V().HasLabel("Patient") }
+	cases := []struct {
+		name      string
+		resources []any
+		access    Accessibility
+		want      *gripql.Query
+	}{
+		{"accessible", resources, accessible, base().Has(gripql.Within("auth_resource_path", resources...))},
+		{"unaccessible", resources, unaccessible, base().Has(gripql.Without("auth_resource_path", resources...))},
+		{"all", resources, all, base()},
+		{"accessible everything", everything, accessible, base()},
+		{"unaccessible everything", everything, unaccessible, base().Has(gripql.Within("auth_resource_path"))},
+	}
+	for _, c := range cases {
+		got := accessibleVertices("Patient", c.resources, c.access)
+		if !reflect.DeepEqual(got.Statements, c.want.Statements) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want.Statements, got.Statements)
+		}
+	}
+	if got := authorizedVertices("Patient", resources); !reflect.DeepEqual(got.Statements, cases[0].want.Statements) {
+		t.Errorf("authorizedVertices should only return accessible vertices, got %v", got.Statements)
+	}
+}
+
+func Test_TierAccess(t *testing.T) {
+	resources := []any{"/programs/a/projects/b"}
+	everything := []any{"*"}
+	cases := []struct {
+		name      string
+		access    Accessibility
+		resources []any
+		limit     int
+		want      int
+		err       bool
+	}{
+		{"accessible", accessible, resources, 0, 0, false},
+		{"all without a limit", all, resources, 0, 0, true},
+		{"unaccessible without a limit", unaccessible, resources, 0, 0, true},
+		{"all", all, resources, 50, 50, false},
+		{"unaccessible", unaccessible, resources, 50, 50, false},
+		{"all everything", all, everything, 0, 0, false},
+	}
+	for _, c := range cases {
+		got, err := minBucketCount(c.access, c.resources, c.limit)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("%s: expected %d (error %v), got %d (%v)", c.name, c.want, c.err, got, err)
+		}
+	}
+	if tierCount(49, 50) != 0 || tierCount(50, 50) != 50 {
+		t.Errorf("expected totals below the limit to be hidden")
+	}
+	if !facetCounted("auth_resource_path", 0) || !facetCounted("gender", 50) || facetCounted("id", 50) {
+		t.Errorf("expected identifiers to be counted only within the user's resources")
+	}
+
+	for v, want := range map[string]int{"": 0, "50": 50} {
+		config := map[string]string{}
+		if v != "" {
+			config["tier_access_limit"] = v
+		}
+		if got, err := parseTierAccessLimit(config); err != nil || got != want {
+			t.Errorf("tier_access_limit '%s': expected %d, got %d (%v)", v, want, got, err)
+		}
+	}
+	for _, v := range []string{"0", "-1", "many"} {
+		if _, err := parseTierAccessLimit(map[string]string{"tier_access_limit": v}); err == nil {
+			t.Errorf("tier_access_limit '%s': expected an error", v)
+		}
+	}
+}
+
+func Test_JSONScalar(t *testing.T) {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"echo": &graphql.Field{
+					Type: JSONScalar,
+					Args: graphql.FieldConfigArgument{ARG_FILTER: &graphql.ArgumentConfig{Type: JSONScalar}},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Args[ARG_FILTER], nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"AND":[{"IN":{"gender":["female","other"]}},{"GTE":{"age":18}},{"EQ":{"deceased":false}}],"note":"x","rate":0.5}`
+	for name, c := range map[string]struct {
+		query     string
+		variables map[string]any
+	}{
+		"literal":  {query: `{ echo(filter: {AND: [{IN: {gender: ["female", "other"]}}, {GTE: {age: 18}}, {EQ: {deceased: false}}], note: "x", rate: 0.5}) }`},
+		"variable": {query: `query ($f: JSON) { echo(filter: $f) }`},
+	} {
+		if name == "variable" {
+			c.variables = map[string]any{}
+			if err := json.Unmarshal([]byte(`{"f": `+expected+`}`), &c.variables); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res := graphql.Do(graphql.Params{Schema: schema, RequestString: c.query, VariableValues: c.variables})
+		if len(res.Errors) > 0 {
+			t.Errorf("%s: %v", name, res.Errors)
+			continue
+		}
+		out, _ := json.Marshal(res.Data.(map[string]any)["echo"])
+		if string(out) != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, out)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// connectionCursor is the position of a row in a connection: the row's sort key values, with the
+// sort they belong to so a cursor isn't used with another sort. Rows are found by their values
+// rather than an offset, so a cursor keeps its place when rows before it are added or removed
+type connectionCursor struct {
+	Sort   string `json:"s"`
+	Values []any  `json:"v"`
+}
+
+// sortSignature names a sort, e.g. 'birthDate:desc,id:asc'
+func sortSignature(keys []sortKey) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		order := "asc"
+		if k.Descending {
+			order = "desc"
+		}
+		parts[i] = k.Field + ":" + order
+	}
+	return strings.Join(parts, ",")
+}
+
+// encodeCursor returns the opaque cursor of a row
+func encodeCursor(row any, keys []sortKey) string {
+	b, _ := json.Marshal(connectionCursor{Sort: sortSignature(keys), Values: rowKeyValues(row, keys)})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the sort key values of an after cursor
+func decodeCursor(cursor string, keys []sortKey) ([]any, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	c := connectionCursor{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	if c.Sort != sortSignature(keys) {
+		return nil, fmt.Errorf("cursor '%s' belongs to another sort, request the connection again from the start", cursor)
+	}
+	// every sort ends on id, which no row is missing
+	if len(c.Values) != len(keys) {
+		return nil, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	if _, ok := c.Values[len(c.Values)-1].(string); !ok {
+		return nil, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	return c.Values, nil
+}
+
+// keysetTerm compares a sort key of a row with a cursor value: eq, neq, gt or lt
+type keysetTerm struct {
+	Field string
+	Op    string
+	Value any
+}
+
+// afterCursorTerms returns the rows that follow a cursor in the sort, as alternatives that each
+// must hold in full: the rows that equal the cursor on the first keys and come after it on the next
+// one. As in grip, rows missing a key sort before any value ascending and after any value
+// descending. id is never missing
+func afterCursorTerms(keys []sortKey, after []any) [][]keysetTerm {
+	out := [][]keysetTerm{}
+	equal := []keysetTerm{}
+	for i, k := range keys {
+		v := after[i]
+		past := []keysetTerm{}
+		switch {
+		case v == nil && k.Descending:
+			// nothing follows the missing values
+		case v == nil:
+			past = append(past, keysetTerm{k.Field, "neq", nil})
+		case k.Descending:
+			past = append(past, keysetTerm{k.Field, "lt", v})
+			if k.Field != "id" {
+				past = append(past, keysetTerm{k.Field, "eq", nil})
+			}
+		default:
+			past = append(past, keysetTerm{k.Field, "gt", v})
+		}
+		for _, t := range past {
+			out = append(out, append(equal[:len(equal):len(equal)], t))
+		}
+		equal = append(equal, keysetTerm{k.Field, "eq", v})
+	}
+	return out
+}
+
+// afterCursor narrows a query down to the rows that follow a cursor in the sort
+func afterCursor(q *gripql.Query, keys []sortKey, after []any) *gripql.Query {
+	alternatives := []*gripql.HasExpression{}
+	for _, terms := range afterCursorTerms(keys, after) {
+		exprs := make([]*gripql.HasExpression, len(terms))
+		for i, t := range terms {
+			field := fieldMap(t.Field)
+			switch t.Op {
+			case "eq":
+				exprs[i] = gripql.Eq(field, t.Value)
+			case "neq":
+				exprs[i] = gripql.Neq(field, t.Value)
+			case "gt":
+				exprs[i] = gripql.Gt(field, t.Value)
+			case "lt":
+				exprs[i] = gripql.Lt(field, t.Value)
+			}
+		}
+		alternatives = append(alternatives, allOf(exprs))
+	}
+	if len(alternatives) == 1 {
+		return q.Has(alternatives[0])
+	}
+	return q.Has(gripql.Or(alternatives...))
+}
+
+// allOf joins expressions with and, a single expression is returned as is
+func allOf(exprs []*gripql.HasExpression) *gripql.HasExpression {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return gripql.And(exprs...)
+}
+
+// pageGids returns the gids of the first vertices of a sorted query, in order, and whether more
+// vertices follow them. Only the vertices are read, so the page is cut before the traversals of
+// the selected fields multiply its rows
+func pageGids(ctx context.Context, client gripql.Client, graph string, q *gripql.Query, first int) ([]string, bool, error) {
+	q = q.Limit(uint32(first + 1)).Fields()
+	res, err := client.Traversal(ctx, &gripql.GraphQuery{Graph: graph, Query: q.Statements})
+	if err != nil {
+		return nil, false, err
+	}
+	gids := []string{}
+	for r := range res {
+		if v := r.GetVertex(); v != nil {
+			gids = append(gids, v.Gid)
+		}
+	}
+	if len(gids) > first {
+		return gids[:first], true, nil
+	}
+	return gids, false, nil
+}
+
+// mergeRows folds rendered rows, one per path through the selected edge fields, back into one
+// row per vertex of the label in the order of the gids, with the neighbours of every path
+// gathered in its edge fields
+func (om *objectMap) mergeRows(rows []any, label string, gids []string) []any {
+	merged := om.mergeNeighbours(rows, label)
+	byID := map[any]any{}
+	for _, r := range merged {
+		byID[r.(map[string]any)["id"]] = r
+	}
+	out := []any{}
+	for _, gid := range gids {
+		if r, ok := byID[gid]; ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// mergeNeighbours merges the rows of the same vertex, in the order they were first seen
+func (om *objectMap) mergeNeighbours(rows []any, label string) []any {
+	label = lower_first_char(label)
+	out := []any{}
+	seen := map[any]map[string]any{}
+	for _, r := range rows {
+		row, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		prev, ok := seen[row["id"]]
+		if !ok {
+			seen[row["id"]] = row
+			out = append(out, row)
+			continue
+		}
+		for field := range om.edgeLabel[label] {
+			if l, ok := row[field].([]any); ok {
+				p, _ := prev[field].([]any)
+				prev[field] = append(p, l...)
+			}
+		}
+	}
+	for _, r := range out {
+		row := r.(map[string]any)
+		for field, dst := range om.edgeDstType[label] {
+			if l, ok := row[field].([]any); ok {
+				row[field] = om.mergeNeighbours(l, dst)
+			}
+		}
+	}
+	return out
+}
+
+// selectedFields returns the fields selected under a path of the query, e.g. edges.node
+func selectedFields(fields []*ast.Field, path ...string) []*ast.Field {
+	for _, name := range path {
+		next := []*ast.Field{}
+		for _, f := range fields {
+			if f.SelectionSet == nil {
+				continue
+			}
+			for _, s := range f.SelectionSet.Selections {
+				if k, ok := s.(*ast.Field); ok && k.Name.Value == name {
+					next = append(next, k)
+				}
+			}
+		}
+		fields = next
+	}
+	return fields
+}
+
+// buildConnectionField creates the Relay style connection query of a type, '<type>Connection(filter, first, after, sort)'
+func buildConnectionField(client gripql.Client, graph string, objects *objectMap, objName string, pageInfo *graphql.Object, resourceList []any) *graphql.Field {
+	obj := objects.objects[objName]
+	label := upper_first_char(obj.Name())
+	edge := graphql.NewObject(graphql.ObjectConfig{
+		Name: objName + "Edge",
+		Fields: graphql.Fields{
+			"node":   &graphql.Field{Type: obj},
+			"cursor": &graphql.Field{Type: graphql.String},
+		},
+	})
+	connection := graphql.NewObject(graphql.ObjectConfig{
+		Name: objName + "Connection",
+		Fields: graphql.Fields{
+			"edges":      &graphql.Field{Type: graphql.NewList(edge)},
+			"pageInfo":   &graphql.Field{Type: pageInfo},
+			"totalCount": &graphql.Field{Type: graphql.Int},
+		},
+	})
+	return &graphql.Field{
+		Name: objName + "Connection",
+		Type: connection,
+		Args: graphql.FieldConfigArgument{
+			ARG_FILTER: &graphql.ArgumentConfig{Type: JSONScalar},
+			ARG_LIMIT:  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100},
+			ARG_AFTER:  &graphql.ArgumentConfig{Type: graphql.String},
+			ARG_SORT:   &graphql.ArgumentConfig{Type: JSONScalar},
+			ARG_ACCESS: &graphql.ArgumentConfig{Type: AccessibilityEnum, DefaultValue: all},
+		},
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			q, err := objects.typeQuery(params.Args, objName, label, resourceList)
+			if err != nil {
+				return nil, err
+			}
+			first := params.Args[ARG_LIMIT].(int)
+			if first < 0 {
+				return nil, fmt.Errorf("first must not be negative, got %d", first)
+			}
+			// without a sort the rows are ordered by id, so cursors are stable either way
+			keys, err := parseSort(params.Args[ARG_SORT], obj)
+			if err != nil {
+				return nil, err
+			}
+			if keys == nil {
+				keys = []sortKey{{Field: "id"}}
+			}
+
+			out := map[string]any{}
+			if len(selectedFields(params.Info.FieldASTs, "totalCount")) > 0 {
+				res, err := client.Traversal(params.Context, &gripql.GraphQuery{Graph: graph, Query: q.Count().Statements})
+				if err != nil {
+					return nil, err
+				}
+				count := 0
+				for r := range res {
+					count = int(r.GetCount())
+				}
+				out["totalCount"] = count
+			}
+
+			if cursor, ok := params.Args[ARG_AFTER].(string); ok && cursor != "" {
+				after, err := decodeCursor(cursor, keys)
+				if err != nil {
+					return nil, err
+				}
+				q = afterCursor(q, keys, after)
+			}
+			// the page's vertices are sorted and cut in the query, the vertex past it tells if more
+			// follow, then the selected fields are rendered for those vertices only
+			gids, hasNext, err := pageGids(params.Context, client, graph, sortQuery(q, keys), first)
+			if err != nil {
+				return nil, err
+			}
+			rows := []any{}
+			if len(gids) > 0 {
+				rendered, err := objects.renderRows(params.Context, client, graph, gripql.V(gids...).HasLabel(label), label, selectedFields(params.Info.FieldASTs, "edges", "node"), -1, 0)
+				if err != nil {
+					return nil, err
+				}
+				rows = objects.mergeRows(rendered, label, gids)
+			}
+			edges := make([]any, len(rows))
+			var endCursor any
+			for i, row := range rows {
+				cursor := encodeCursor(row, keys)
+				edges[i] = map[string]any{"node": row, "cursor": cursor}
+				endCursor = cursor
+			}
+			out["edges"] = edges
+			out["pageInfo"] = map[string]any{"hasNextPage": hasNext, "endCursor": endCursor}
+			return out, nil
+		},
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func Test_ConnectionCursor(t *testing.T) {
+	byAge, _ := parseSort([]any{map[string]any{"age": "desc"}}, testPatient)
+	byID := []sortKey{{Field: "id"}}
+	row := map[string]any{"id": "p1", "age": 42.0}
+
+	cursor := encodeCursor(row, byAge)
+	values, err := decodeCursor(cursor, byAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []any{42.0, "p1"}) {
+		t.Errorf("expected cursor values [42 p1], got %v", values)
+	}
+	if encodeCursor(row, byAge) != cursor {
+		t.Errorf("expected the same row to always have the same cursor")
+	}
+	if _, err := decodeCursor(cursor, byID); err == nil || !strings.Contains(err.Error(), "another sort") {
+		t.Errorf("expected a cursor of another sort to be rejected, got %v", err)
+	}
+	for _, bad := range []string{"not a cursor!", "bm90IGpzb24", encodeCursor(row, byID)[:4]} {
+		if _, err := decodeCursor(bad, byID); err == nil {
+			t.Errorf("%s: expected invalid cursor error", bad)
+		}
+	}
+}
+
+func Test_ConnectionAfterCursor(t *testing.T) {
+	base := func() *gripql.Query { return gripql.V().HasLabel("Patient") }
+	byAge, _ := parseSort([]any{map[string]any{"age": "desc"}}, testPatient)
+	byBirthAge, _ := parseSort([]any{map[string]any{"birthDate": "asc"}, map[string]any{"age": "desc"}}, testPatient)
+	cases := []struct {
+		name  string
+		keys  []sortKey
+		after []any
+		want  *gripql.Query
+	}{
+		{
+			"id", []sortKey{{Field: "id"}}, []any{"p1"},
+			base().Has(gripql.Gt("_gid", "p1")),
+		},
+		{
+			"age desc", byAge, []any{30.0, "p1"},
+			base().Has(gripql.Or(
+				gripql.Lt("age", 30.0),
+				gripql.Eq("age", nil),
+				gripql.And(gripql.Eq("age", 30.0), gripql.Gt("_gid", "p1")),
+			)),
+		},
+		{
+			"birthDate asc, age desc", byBirthAge, []any{"2000-01-01", 30.0, "p1"},
+			base().Has(gripql.Or(
+				gripql.Gt("birthDate", "2000-01-01"),
+				gripql.And(gripql.Eq("birthDate", "2000-01-01"), gripql.Lt("age", 30.0)),
+				gripql.And(gripql.Eq("birthDate", "2000-01-01"), gripql.Eq("age", nil)),
+				gripql.And(gripql.Eq("birthDate", "2000-01-01"), gripql.Eq("age", 30.0), gripql.Gt("_gid", "p1")),
+			)),
+		},
+	}
+	for _, c := range cases {
+		got := afterCursor(base(), c.keys, c.after)
+		if !reflect.DeepEqual(got.Statements, c.want.Statements) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want.Statements, got.Statements)
+		}
+	}
+
+	// a cursor that lost its id can't be placed
+	cursor := encodeCursor(map[string]any{"age": 30.0}, byAge)
+	if _, err := decodeCursor(cursor, byAge); err == nil {
+		t.Errorf("expected a cursor without an id to be rejected")
+	}
+}
+
+// keysetMatch evaluates the terms of a cursor against a row the way grip compares values
+func keysetMatch(row map[string]any, terms []keysetTerm) bool {
+	compare := func(a, b any) int {
+		switch x := a.(type) {
+		case float64:
+			y := b.(float64)
+			if x < y {
+				return -1
+			} else if x > y {
+				return 1
+			}
+			return 0
+		case string:
+			return strings.Compare(x, b.(string))
+		}
+		return 0
+	}
+	for _, term := range terms {
+		v := row[term.Field]
+		ok := false
+		switch {
+		case term.Op == "eq" && term.Value == nil:
+			ok = v == nil
+		case term.Op == "neq" && term.Value == nil:
+			ok = v != nil
+		case v == nil:
+			ok = false
+		case term.Op == "eq":
+			ok = compare(v, term.Value) == 0
+		case term.Op == "gt":
+			ok = compare(v, term.Value) > 0
+		case term.Op == "lt":
+			ok = compare(v, term.Value) < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_ConnectionKeysetOrder(t *testing.T) {
+	rows := map[string]map[string]any{
+		"a": {"id": "a", "age": 30.0},
+		"b": {"id": "b", "age": 40.0},
+		"c": {"id": "c"},
+		"d": {"id": "d", "age": 30.0},
+		"e": {"id": "e", "age": 40.0},
+		"f": {"id": "f"},
+	}
+	// grip's order: missing values first ascending, last descending, ties by id
+	for _, c := range []struct {
+		sort  string
+		order []string
+	}{
+		{"asc", []string{"c", "f", "a", "d", "b", "e"}},
+		{"desc", []string{"b", "e", "a", "d", "c", "f"}},
+	} {
+		keys, _ := parseSort([]any{map[string]any{"age": c.sort}}, testPatient)
+		for i, id := range c.order {
+			terms := afterCursorTerms(keys, rowKeyValues(rows[id], keys))
+			following := []string{}
+			for _, other := range c.order {
+				for _, alt := range terms {
+					if keysetMatch(rows[other], alt) {
+						following = append(following, other)
+						break
+					}
+				}
+			}
+			if got, want := strings.Join(following, ","), strings.Join(c.order[i+1:], ","); got != want {
+				t.Errorf("age %s after %s: expected %s to follow, got %s", c.sort, id, want, got)
+			}
+		}
+	}
+}
+
+func Test_ConnectionMergeRows(t *testing.T) {
+	om := &objectMap{
+		edgeLabel:   map[string]map[string]string{"patient": {"observations": "observations"}, "observation": {}},
+		edgeDstType: map[string]map[string]string{"patient": {"observations": "observation"}, "observation": {}},
+	}
+	o := func(id string) map[string]any { return map[string]any{"id": id} }
+	// a patient with two observations is rendered as a row per observation
+	rendered := []any{
+		map[string]any{"id": "p1", "observations": []any{o("o1")}},
+		map[string]any{"id": "p1", "observations": []any{o("o2")}},
+		map[string]any{"id": "p2"},
+	}
+	got := om.mergeRows(rendered, "Patient", []string{"p2", "p1"})
+	want := []any{
+		map[string]any{"id": "p2"},
+		map[string]any{"id": "p1", "observations": []any{o("o1"), o("o2")}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func Test_ConnectionSelectedFields(t *testing.T) {
+	doc, err := parser.Parse(parser.ParseParams{Source: `{ patientConnection { totalCount edges { cursor node { id age } } } }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := doc.Definitions[0].(*ast.OperationDefinition)
+	root := []*ast.Field{op.SelectionSet.Selections[0].(*ast.Field)}
+	nodes := selectedFields(root, "edges", "node")
+	if len(nodes) != 1 || len(nodes[0].SelectionSet.Selections) != 2 {
+		t.Errorf("expected the node selection, got %v", nodes)
+	}
+	if len(selectedFields(root, "totalCount")) != 1 || len(selectedFields(root, "pageInfo")) != 0 {
+		t.Errorf("expected only totalCount to be selected")
+	}
+}
@@ -2,50 +2,309 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
 	"github.com/bmeg/grip/gripql"
-	"github.com/bmeg/grip/log"
+	"github.com/graphql-go/graphql"
 )
 
+// FilterBuilder translates a Guppy filter into GripQL Has expressions. The grammar is:
+//
+//	filter   := {"AND": [filter, ...]} | {"OR": [filter, ...]} | {op: {field: value}} | {"search": {"keyword": k, "fields": [field, ...]}}
+//	          | {"nested": {"path": edge, ...filter}}
+//	op       := "=" | "!=" | "IN" | "NOT_IN" | ">" | ">=" | "<" | "<=" | "exists" | "is"
+//
+// Operators are also accepted by name (EQ, NE, GT, GTE, LT, LTE, IN) in either case, since
+// GraphQL literals can't spell '>='. A node with several operators, or an operator with several
+// fields, is the AND of them. A nested filter matches the vertices with a neighbor, across the
+// edge field named by path, that matches the rest of the nested object.
 type FilterBuilder struct {
 	filter map[string]any
+	// fields are the fields the filter may name, nil to accept any field
+	fields []string
+	// types are the schema types filter values are coerced to, by field
+	types map[string]string
+	// objects and object resolve the edge fields of nested filters, which are rejected without them
+	objects *objectMap
+	object  string
+	// resources are the user's resources, the neighbours nested filters test are limited to them
+	resources []any
+}
+
+// NewFilterBuilder creates the builder of a filter on the fields of obj, whose values are coerced to
+// the schema types of the fields. A nil obj accepts any field, and fields without a type keep their values
+func NewFilterBuilder(i map[string]any, obj *graphql.Object, types map[string]string) *FilterBuilder {
+	fb := &FilterBuilder{filter: i, types: types}
+	if obj != nil {
+		fb.fields = filterableFields(obj)
+	}
+	return fb
+}
+
+// filterArg returns the builder of the filter argument of a query on an object, nil if there is none.
+// Nested filters only test the neighbours in the user's resources
+func filterArg(args map[string]any, objects *objectMap, object string, resourceList []any) (*FilterBuilder, error) {
+	switch f := args[ARG_FILTER].(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		fb := NewFilterBuilder(f, nil, nil)
+		fb.resources = resourceList
+		return fb.on(objects, object), nil
+	}
+	return nil, &FilterError{Path: "$", Message: fmt.Sprintf("expected a filter object, got %v", args[ARG_FILTER]), Operators: filterOperatorNames}
+}
+
+// on returns a builder of the filter on another object of the schema
+func (fb *FilterBuilder) on(objects *objectMap, object string) *FilterBuilder {
+	out := NewFilterBuilder(fb.filter, objects.objects[object], objects.fieldTypes[object])
+	out.objects, out.object, out.resources = objects, object, fb.resources
+	return out
+}
+
+// edgeFields returns the edge fields nested filters can follow from the object
+func (fb *FilterBuilder) edgeFields() []string {
+	out := []string{}
+	for f := range fb.objects.edgeLabel[fb.object] {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// filterableFields returns the scalar and list of scalar fields of an object
+func filterableFields(obj *graphql.Object) []string {
+	out := []string{}
+	for k, v := range obj.Fields() {
+		t := v.Type
+		if l, ok := t.(*graphql.List); ok {
+			t = l.OfType
+		}
+		switch t {
+		case graphql.String, graphql.Int, graphql.Float, graphql.Boolean:
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
 }
 
-func NewFilterBuilder(i map[string]any) *FilterBuilder {
-	return &FilterBuilder{i}
+// FilterError is an invalid node of a filter. It is returned as a GraphQL error whose extensions
+// give the JSON path of the node, and the fields or operators allowed there
+type FilterError struct {
+	Path      string
+	Message   string
+	Fields    []string
+	Operators []string
 }
 
-func isFilterEQ(q map[string]any) (any, bool) {
-	if val, ok := q["IN"]; ok {
-		return val, ok
+func (fe *FilterError) Error() string {
+	msg := fmt.Sprintf("invalid filter at %s: %s", fe.Path, fe.Message)
+	if len(fe.Fields) > 0 {
+		msg += fmt.Sprintf(". Allowed fields are: %s", strings.Join(fe.Fields, ", "))
 	}
-	return q, false
+	if len(fe.Operators) > 0 {
+		msg += fmt.Sprintf(". Allowed operators are: %s", strings.Join(fe.Operators, ", "))
+	}
+	return msg
 }
 
-func isFilter(q map[string]any) (any, bool) {
-	// this first and doesn't seem to suit any purpose
-	// but it is consistant across exploration page queries
-	if val, ok := q["AND"]; ok {
-		return val, ok
+// Extensions implements gqlerrors.ExtendedError
+func (fe *FilterError) Extensions() map[string]any {
+	ext := map[string]any{"code": "INVALID_FILTER", "path": fe.Path}
+	if len(fe.Fields) > 0 {
+		ext["allowedFields"] = fe.Fields
+	}
+	if len(fe.Operators) > 0 {
+		ext["allowedOperators"] = fe.Operators
 	}
-	return nil, false
+	return ext
 }
 
-func isFilterGT(q map[string]any) (any, bool) {
-	for _, i := range []string{">=", "gt", "GT"} {
-		if val, ok := q[i]; ok {
-			return val, ok
+// filterOperatorNames are the operators listed in errors, one spelling of each
+var filterOperatorNames = []string{"AND", "OR", "=", "!=", ">", ">=", "<", "<=", "IN", "NOT_IN", "exists", "is", "search", "nested"}
+
+// childPath extends the JSON path of a filter node with an object key
+func childPath(path string, key string) string {
+	for _, r := range key {
+		if !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return fmt.Sprintf("%s[%q]", path, key)
 		}
 	}
-	return nil, false
+	return path + "." + key
 }
 
-func isFilterLT(q map[string]any) (any, bool) {
-	for _, i := range []string{"<=", "lt", "LT"} {
-		if val, ok := q[i]; ok {
-			return val, ok
+// coerceValue converts a filter value to a schema type, so a portal sending "66" for a NUMERIC
+// field or 66 for a STRING code still matches. Lists are converted element-wise, null is kept
+func coerceValue(t string, value any) (any, error) {
+	if l, ok := value.([]any); ok {
+		out := make([]any, len(l))
+		for i, v := range l {
+			c, err := coerceValue(t, v)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
 		}
+		return out, nil
 	}
-	return nil, false
+	if value == nil {
+		return nil, nil
+	}
+	switch t {
+	case "NUMERIC":
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+	case "BOOL":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, nil
+			}
+		}
+	case "STRING":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int:
+			return strconv.Itoa(v), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	default:
+		return value, nil
+	}
+	return nil, fmt.Errorf("cannot use %#v as a %s value", value, t)
+}
+
+// coerce converts the value of a field to the field's schema type
+func (fb *FilterBuilder) coerce(field string, value any) (any, error) {
+	t, ok := fb.types[field]
+	if !ok {
+		return value, nil
+	}
+	return coerceValue(t, value)
+}
+
+// filterOperator is a leaf operator, building the expression for one field and value
+type filterOperator func(field string, value any) (*gripql.HasExpression, error)
+
+func listValue(value any) ([]any, error) {
+	values, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a list of values, got %v", value)
+	}
+	for _, v := range values {
+		if err := scalarValue(v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func scalarValue(value any) error {
+	switch value.(type) {
+	case nil, string, float64, int, bool:
+		return nil
+	}
+	return fmt.Errorf("expected a single value, got %v", value)
+}
+
+// comparison builds an operator comparing a field to a single value
+func comparison(cmp func(string, any) *gripql.HasExpression) filterOperator {
+	return func(field string, value any) (*gripql.HasExpression, error) {
+		if err := scalarValue(value); err != nil {
+			return nil, err
+		}
+		return cmp(field, value), nil
+	}
+}
+
+// ordering builds an operator ordering a field against a number or string
+func ordering(cmp func(string, any) *gripql.HasExpression) filterOperator {
+	return func(field string, value any) (*gripql.HasExpression, error) {
+		switch value.(type) {
+		case string, float64, int:
+			return cmp(field, value), nil
+		}
+		return nil, fmt.Errorf("expected a number or string, got %v", value)
+	}
+}
+
+var filterOperators = map[string]filterOperator{
+	"=":  comparison(gripql.Eq),
+	"!=": comparison(gripql.Neq),
+	">":  ordering(gripql.Gt),
+	">=": ordering(gripql.Gte),
+	"<":  ordering(gripql.Lt),
+	"<=": ordering(gripql.Lte),
+	"in": func(field string, value any) (*gripql.HasExpression, error) {
+		values, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return gripql.Within(field, values...), nil
+	},
+	"not_in": func(field string, value any) (*gripql.HasExpression, error) {
+		values, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return gripql.Without(field, values...), nil
+	},
+	// exists: {field: true} matches elements with a value for the field, false those without
+	"exists": func(field string, value any) (*gripql.HasExpression, error) {
+		exists, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("exists takes true or false, got %v", value)
+		}
+		if exists {
+			return gripql.Neq(field, nil), nil
+		}
+		return gripql.Eq(field, nil), nil
+	},
+	// is: {field: null} matches elements without a value for the field
+	"is": func(field string, value any) (*gripql.HasExpression, error) {
+		if value != nil {
+			return nil, fmt.Errorf("is only takes null, got %v", value)
+		}
+		return gripql.Eq(field, nil), nil
+	},
+}
+
+// operatorAliases maps the spellings of each operator to its filterOperators key
+var operatorAliases = map[string]string{
+	"=": "=", "eq": "=",
+	"!=": "!=", "ne": "!=", "neq": "!=",
+	">": ">", "gt": ">",
+	">=": ">=", "gte": ">=",
+	"<": "<", "lt": "<",
+	"<=": "<=", "lte": "<=",
+	"in":     "in",
+	"not_in": "not_in", "notin": "not_in",
+	"exists": "exists",
+	"is":     "is",
+}
+
+// filterCombinators are the operators taking a list of filters
+var filterCombinators = map[string]func(...*gripql.HasExpression) *gripql.HasExpression{
+	"and": gripql.And,
+	"or":  gripql.Or,
 }
 
 func fieldMap(s string) string {
@@ -55,83 +314,241 @@ func fieldMap(s string) string {
 	return s
 }
 
-func (fb *FilterBuilder) ExtendGrip(q *gripql.Query, filterSelfName string) (*gripql.Query, error) {
-	// isFilter filters out a top level "AND" that seems to be consistant across all queries in the exploration page
-	if is_filter, ok := isFilter(fb.filter); ok {
-		fmt.Println("FILTER: ", is_filter)
-		for _, array_filter := range is_filter.([]any) {
-			// 'Checkbox' filter logic
-			if map_array_filter, ok := array_filter.(map[string]any); ok {
-				if mis_filter, ok := isFilterEQ(map_array_filter); ok {
-					if map_eq_arr_filter, ok := mis_filter.(map[string]any); ok {
-						for filter_key, arr_filter_values := range map_eq_arr_filter {
-							filter_key = fieldMap(filter_key)
-							if filter_values, ok := arr_filter_values.([]any); ok {
-
-								// This is where the 'filterSelf' like Guppy parameter is implemented:
-								// If the current property that is being passed into the filter function
-								// is the same as the current interated key then return early and skip filtering self
-								if filterSelfName != "" && filter_key == filterSelfName {
-									log.Infof("FilterSelf Query Condition Hit %s", q.String())
-									return q, nil
-
-									// otherwise split filtering by 1 checked box or multiple checked boxes
-									// build the query with ORs like it is done in the current data portal
-								} else if len(filter_values) == 1 {
-									q = q.Has(gripql.Within(filter_key, filter_values[0]))
-
-								} else if len(filter_values) > 1 {
-									final_expr := gripql.Or(gripql.Within(filter_key, filter_values[0]), gripql.Within(filter_key, filter_values[1]))
-									for i := 2; i < len(filter_values); i++ {
-										final_expr = gripql.Or(final_expr, gripql.Within(filter_key, filter_values[i]))
-									}
-									q = q.Has(final_expr)
-								} else {
-									log.Error("Error state checkbox filter not populated but list was created")
-								}
-
-							}
-
-						}
-					}
-				}
+// sortedKeys returns the keys of a filter node in a stable order, so the same filter always
+// builds the same query
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// combine joins expressions, dropping the empty ones left by filterSelf
+func combine(join func(...*gripql.HasExpression) *gripql.HasExpression, exprs []*gripql.HasExpression) *gripql.HasExpression {
+	out := []*gripql.HasExpression{}
+	for _, e := range exprs {
+		if e != nil {
+			out = append(out, e)
+		}
+	}
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return out[0]
+	}
+	return join(out...)
+}
+
+// checkField returns an error if the filter can't name a field
+func (fb *FilterBuilder) checkField(path string, field string) error {
+	if fb.fields == nil {
+		return nil
+	}
+	i := sort.SearchStrings(fb.fields, field)
+	if i < len(fb.fields) && fb.fields[i] == field {
+		return nil
+	}
+	return &FilterError{Path: path, Message: fmt.Sprintf("unknown field '%s'", field), Fields: fb.fields}
+}
+
+// nestedFilter is a filter on the neighbors of a vertex across an edge field
+type nestedFilter struct {
+	path   string
+	field  string
+	label  string
+	dst    string
+	filter map[string]any
+}
+
+// parseNested reads the {"path": edge, ...filter} object of a nested filter
+func (fb *FilterBuilder) parseNested(value any, path string) (nestedFilter, error) {
+	if fb.objects == nil {
+		return nestedFilter{}, &FilterError{Path: path, Message: "nested filters are not supported here"}
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		return nestedFilter{}, &FilterError{Path: path, Message: fmt.Sprintf("expected {\"path\": edge, ...filter}, got %v", value), Fields: fb.edgeFields()}
+	}
+	field, _ := m["path"].(string)
+	label, ok := fb.objects.edgeLabel[fb.object][field]
+	if !ok {
+		return nestedFilter{}, &FilterError{Path: childPath(path, "path"), Message: fmt.Sprintf("%s has no edge field '%v'", fb.object, m["path"]), Fields: fb.edgeFields()}
+	}
+	n := nestedFilter{path: path, field: field, label: label, dst: fb.objects.edgeDstType[fb.object][field], filter: map[string]any{}}
+	for k, v := range m {
+		if k != "path" {
+			n.filter[k] = v
+		}
+	}
+	return n, nil
+}
 
+// expression translates the filter node at a JSON path. Conditions on the skip field are left out,
+// which is how an aggregation of a field ignores the filter on that same field (Guppy's filterSelf: false).
+// Nested filters are traversals rather than expressions, they are collected into nested, which is
+// nil where they can't be used as they could only be ANDed with the rest of the filter
+func (fb *FilterBuilder) expression(node any, path string, skip string, nested *[]nestedFilter) (*gripql.HasExpression, error) {
+	m, ok := node.(map[string]any)
+	if !ok {
+		return nil, &FilterError{Path: path, Message: fmt.Sprintf("expected a filter object, got %v", node), Operators: filterOperatorNames}
+	}
+	exprs := []*gripql.HasExpression{}
+	for _, key := range sortedKeys(m) {
+		value := m[key]
+		keyPath := childPath(path, key)
+		op := strings.ToLower(key)
+		if join, ok := filterCombinators[op]; ok {
+			children, ok := value.([]any)
+			if !ok {
+				return nil, &FilterError{Path: keyPath, Message: fmt.Sprintf("expected a list of filters, got %v", value)}
+			}
+			childNested := nested
+			if op != "and" {
+				childNested = nil
 			}
-			// 'Slider' filter logic. Don't think filter self is needed
-			// for slider since it accepts a range of values
-			if map_array_filter, ok := array_filter.(map[string]any); ok {
-				if is_filter, ok := isFilter(map_array_filter); ok {
-					if map_eq_arr_filter, ok := is_filter.([]any); ok {
-						for _, v := range map_eq_arr_filter {
-							if map_array_filter, ok := v.(map[string]any); ok {
-								if val, ok := isFilterGT(map_array_filter); ok {
-									if vMap, ok := val.(map[string]any); ok {
-										for k, v := range vMap {
-											k = fieldMap(k)
-											q = q.Has(gripql.Gt(k, v))
-										}
-									}
-								}
-
-								if val, ok := isFilterLT(map_array_filter); ok {
-									if vMap, ok := val.(map[string]any); ok {
-										for k, v := range vMap {
-											k = fieldMap(k)
-											q = q.Has(gripql.Lt(k, v))
-										}
-									}
-								}
-
-							} else {
-								log.Error("Error state slider filter not populated but list was created")
-							}
-						}
-					}
+			childExprs := []*gripql.HasExpression{}
+			for i, child := range children {
+				e, err := fb.expression(child, fmt.Sprintf("%s[%d]", keyPath, i), skip, childNested)
+				if err != nil {
+					return nil, err
 				}
+				childExprs = append(childExprs, e)
+			}
+			exprs = append(exprs, combine(join, childExprs))
+			continue
+		}
+		if op == "nested" {
+			if nested == nil {
+				return nil, &FilterError{Path: keyPath, Message: "nested filters can only be combined with AND"}
+			}
+			n, err := fb.parseNested(value, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			*nested = append(*nested, n)
+			continue
+		}
+		if op == "search" {
+			e, err := fb.searchExpression(value, keyPath, skip)
+			if err != nil {
+				return nil, err
 			}
+			exprs = append(exprs, e)
+			continue
+		}
+		name, ok := operatorAliases[op]
+		if !ok {
+			return nil, &FilterError{Path: keyPath, Message: fmt.Sprintf("unknown filter operator '%s'", key), Operators: filterOperatorNames}
+		}
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil, &FilterError{Path: keyPath, Message: fmt.Sprintf("expected a {field: value} object, got %v", value), Fields: fb.fields}
+		}
+		for _, field := range sortedKeys(fields) {
+			fieldPath := childPath(keyPath, field)
+			if err := fb.checkField(fieldPath, field); err != nil {
+				return nil, err
+			}
+			if skip != "" && fieldMap(field) == skip {
+				continue
+			}
+			value := fields[field]
+			if name != "exists" && name != "is" {
+				var err error
+				if value, err = fb.coerce(field, value); err != nil {
+					return nil, &FilterError{Path: fieldPath, Message: err.Error()}
+				}
+			}
+			e, err := filterOperators[name](fieldMap(field), value)
+			if err != nil {
+				return nil, &FilterError{Path: fieldPath, Message: err.Error()}
+			}
+			exprs = append(exprs, e)
+		}
+	}
+	return combine(gripql.And, exprs), nil
+}
 
+// searchExpression matches a keyword against the values of several fields. GripQL has no
+// substring match, so the keyword must equal a field value or an element of a list field
+func (fb *FilterBuilder) searchExpression(value any, path string, skip string) (*gripql.HasExpression, error) {
+	m, ok := value.(map[string]any)
+	if !ok {
+		return nil, &FilterError{Path: path, Message: fmt.Sprintf("expected {\"keyword\": ..., \"fields\": [...]}, got %v", value)}
+	}
+	keyword, ok := m["keyword"].(string)
+	if !ok {
+		return nil, &FilterError{Path: childPath(path, "keyword"), Message: fmt.Sprintf("keyword must be a string, got %v", m["keyword"])}
+	}
+	fields, ok := m["fields"].([]any)
+	if !ok || len(fields) == 0 {
+		return nil, &FilterError{Path: childPath(path, "fields"), Message: fmt.Sprintf("fields must be a list of field names, got %v", m["fields"]), Fields: fb.fields}
+	}
+	exprs := []*gripql.HasExpression{}
+	for i, f := range fields {
+		fieldPath := fmt.Sprintf("%s[%d]", childPath(path, "fields"), i)
+		field, ok := f.(string)
+		if !ok {
+			return nil, &FilterError{Path: fieldPath, Message: fmt.Sprintf("field names must be strings, got %v", f), Fields: fb.fields}
+		}
+		if err := fb.checkField(fieldPath, field); err != nil {
+			return nil, err
+		}
+		value, err := fb.coerce(field, keyword)
+		if err != nil {
+			return nil, &FilterError{Path: fieldPath, Message: fmt.Sprintf("%s of %s", err, field)}
+		}
+		if field = fieldMap(field); skip != "" && field == skip {
+			continue
+		}
+		exprs = append(exprs, gripql.Or(gripql.Eq(field, value), gripql.Contains(field, value)))
+	}
+	return combine(gripql.Or, exprs), nil
+}
+
+// ExtendGrip adds the filter to a query. filterSelfName is the field being aggregated, whose own
+// conditions are left out of the filter
+func (fb *FilterBuilder) ExtendGrip(q *gripql.Query, filterSelfName string) (*gripql.Query, error) {
+	if fb == nil {
+		return q, nil
+	}
+	if filterSelfName != "" {
+		filterSelfName = fieldMap(filterSelfName)
+	}
+	marks := 0
+	return fb.extend(q, fb.filter, "$", filterSelfName, &marks)
+}
+
+// extend adds a filter node to a query. Each nested filter marks the current vertex, moves to
+// its neighbors across the edge that are in the user's resources, filters them and selects the
+// marked vertex back, once however many of its neighbors match
+func (fb *FilterBuilder) extend(q *gripql.Query, node any, path string, skip string, marks *int) (*gripql.Query, error) {
+	nested := []nestedFilter{}
+	expr, err := fb.expression(node, path, skip, &nested)
+	if err != nil {
+		return nil, err
+	}
+	if expr != nil {
+		q = q.Has(expr)
+	}
+	for _, n := range nested {
+		*marks++
+		mark := fmt.Sprintf("_nested%d", *marks)
+		q = q.As(mark).Out(n.label)
+		if n.field != n.label {
+			// the field is '<label>_to_<dst>' when the label leads to several types
+			q = q.HasLabel(upper_first_char(n.dst))
+		}
+		// records the user can't read must not be tested either, whatever the accessibility
+		q = accessFilter(q, fb.resources, accessible)
+		q, err = fb.on(fb.objects, n.dst).extend(q, n.filter, n.path, "", marks)
+		if err != nil {
+			return nil, err
 		}
+		q = q.Select(mark).Distinct("_gid")
 	}
-	log.Infof("Filter Query %s", q.String())
 	return q, nil
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql"
+)
+
+func parseFilter(t *testing.T, s string) map[string]any {
+	f := map[string]any{}
+	if err := json.Unmarshal([]byte(s), &f); err != nil {
+		t.Fatalf("%s: %s", s, err)
+	}
+	return f
+}
+
+func Test_FilterGolden(t *testing.T) {
+	cases := []struct {
+		name   string
+		filter string
+		skip   string
+		want   *gripql.HasExpression
+	}{
+		{"eq", `{"=": {"gender": "female"}}`, "", gripql.Eq("gender", "female")},
+		{"eq name", `{"EQ": {"gender": "female"}}`, "", gripql.Eq("gender", "female")},
+		{"neq", `{"!=": {"gender": "male"}}`, "", gripql.Neq("gender", "male")},
+		{"gt", `{">": {"age": 18}}`, "", gripql.Gt("age", 18.0)},
+		{"gte", `{"GTE": {"age": 18}}`, "", gripql.Gte("age", 18.0)},
+		{"lt", `{"lt": {"age": 65}}`, "", gripql.Lt("age", 65.0)},
+		{"lte", `{"<=": {"age": 65}}`, "", gripql.Lte("age", 65.0)},
+		{"in", `{"IN": {"gender": ["female", "other"]}}`, "", gripql.Within("gender", "female", "other")},
+		{"not in", `{"NOT_IN": {"gender": ["male"]}}`, "", gripql.Without("gender", "male")},
+		{"exists", `{"exists": {"deceased": true}}`, "", gripql.Neq("deceased", nil)},
+		{"not exists", `{"exists": {"deceased": false}}`, "", gripql.Eq("deceased", nil)},
+		{"is null", `{"is": {"deceased": null}}`, "", gripql.Eq("deceased", nil)},
+		{"id", `{"=": {"id": "p1"}}`, "", gripql.Eq("_gid", "p1")},
+		{"search", `{"search": {"keyword": "flu", "fields": ["code", "alias"]}}`, "", gripql.Or(
+			gripql.Or(gripql.Eq("code", "flu"), gripql.Contains("code", "flu")),
+			gripql.Or(gripql.Eq("alias", "flu"), gripql.Contains("alias", "flu")),
+		)},
+		{"and", `{"AND": [{"IN": {"gender": ["female"]}}, {"AND": [{">=": {"age": 18}}, {"<=": {"age": 65}}]}]}`, "", gripql.And(
+			gripql.Within("gender", "female"),
+			gripql.And(gripql.Gte("age", 18.0), gripql.Lte("age", 65.0)),
+		)},
+		{"or", `{"OR": [{"=": {"gender": "female"}}, {"<": {"age": 18}}]}`, "", gripql.Or(gripql.Eq("gender", "female"), gripql.Lt("age", 18.0))},
+		{"or in and", `{"and": [{"or": [{"=": {"a": 1}}, {"=": {"b": 2}}]}, {"!=": {"c": 3}}]}`, "", gripql.And(
+			gripql.Or(gripql.Eq("a", 1.0), gripql.Eq("b", 2.0)),
+			gripql.Neq("c", 3.0),
+		)},
+		{"several operators", `{"<": {"age": 65}, ">": {"age": 18}}`, "", gripql.And(gripql.Lt("age", 65.0), gripql.Gt("age", 18.0))},
+		{"several fields", `{"=": {"b": 2, "a": 1}}`, "", gripql.And(gripql.Eq("a", 1.0), gripql.Eq("b", 2.0))},
+		{"single child", `{"AND": [{"=": {"a": 1}}]}`, "", gripql.Eq("a", 1.0)},
+		{"filter self", `{"AND": [{"IN": {"gender": ["female"]}}, {">=": {"age": 18}}]}`, "gender", gripql.Gte("age", 18.0)},
+		{"filter self only", `{"AND": [{"IN": {"gender": ["female"]}}]}`, "gender", nil},
+		{"empty", `{}`, "", nil},
+	}
+	for _, c := range cases {
+		got, err := NewFilterBuilder(parseFilter(t, c.filter), nil, nil).ExtendGrip(gripql.V().HasLabel("Patient"), c.skip)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		want := gripql.V().HasLabel("Patient")
+		if c.want != nil {
+			want = want.Has(c.want)
+		}
+		if !reflect.DeepEqual(got.Statements, want.Statements) {
+			t.Errorf("%s: expected %s, got %s", c.name, want.String(), got.String())
+		}
+	}
+}
+
+func Test_FilterErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"LIKE": {"gender": "f"}}`:                    "unknown filter operator 'LIKE'",
+		`{"AND": {"=": {"a": 1}}}`:                     "expected a list of filters",
+		`{"IN": {"gender": "female"}}`:                 "expected a list of values",
+		`{"=": ["gender", "female"]}`:                  "expected a {field: value} object",
+		`{"exists": {"gender": "yes"}}`:                "exists takes true or false",
+		`{"search": {"keyword": "flu", "fields": []}}`: "fields must be a list",
+	}
+	for filter, msg := range cases {
+		_, err := NewFilterBuilder(parseFilter(t, filter), nil, nil).ExtendGrip(gripql.V(), "")
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", filter, msg, err)
+		}
+	}
+}
+
+func Test_FilterValidation(t *testing.T) {
+	cases := []struct {
+		filter    string
+		path      string
+		message   string
+		fields    bool
+		operators bool
+	}{
+		{`{"AND": [{"IN": {"gender": ["female"]}}]}`, "$.AND[0].IN.gender", "unknown field 'gender'", true, false},
+		{`{"AND": [{"=": {"id": "p1"}}, {"OR": [{"GTE": {"age": 18}}, {">": {"agee": 18}}]}]}`, `$.AND[1].OR[1][">"].agee`, "unknown field 'agee'", true, false},
+		{`{"and": [{"LIKE": {"age": 18}}]}`, "$.and[0].LIKE", "unknown filter operator 'LIKE'", false, true},
+		{`{"AND": ["age"]}`, "$.AND[0]", "expected a filter object", false, true},
+		{`{"OR": {"=": {"age": 18}}}`, "$.OR", "expected a list of filters", false, false},
+		{`{"=": {"age": [18, 19]}}`, `$["="].age`, "expected a single value", false, false},
+		{`{"GT": {"age": true}}`, "$.GT.age", "expected a number or string", false, false},
+		{`{"IN": {"alias": [["a"]]}}`, "$.IN.alias", "expected a single value", false, false},
+		{`{"IN": ["alias"]}`, "$.IN", "expected a {field: value} object", true, false},
+		{`{"search": {"keyword": "flu", "fields": ["code"]}}`, "$.search.fields[0]", "unknown field 'code'", true, false},
+	}
+	for _, c := range cases {
+		_, err := NewFilterBuilder(parseFilter(t, c.filter), testPatient, nil).ExtendGrip(gripql.V(), "")
+		fe, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("%s: expected a FilterError, got %v", c.filter, err)
+			continue
+		}
+		if fe.Path != c.path || !strings.Contains(fe.Message, c.message) {
+			t.Errorf("%s: expected %q at %s, got %q at %s", c.filter, c.message, c.path, fe.Message, fe.Path)
+		}
+		if (len(fe.Fields) > 0) != c.fields || (len(fe.Operators) > 0) != c.operators {
+			t.Errorf("%s: unexpected allowed fields %v or operators %v", c.filter, fe.Fields, fe.Operators)
+		}
+		if c.fields && strings.Join(fe.Fields, ",") != "age,alias,birthDate,id" {
+			t.Errorf("%s: expected the scalar fields of patient, got %v", c.filter, fe.Fields)
+		}
+		if ext := fe.Extensions(); ext["path"] != c.path || ext["code"] != "INVALID_FILTER" {
+			t.Errorf("%s: unexpected extensions %v", c.filter, ext)
+		}
+	}
+
+	valid := `{"AND": [{"IN": {"alias": ["a"]}}, {">=": {"age": 18}}, {"=": {"id": "p1"}}]}`
+	if _, err := NewFilterBuilder(parseFilter(t, valid), testPatient, nil).ExtendGrip(gripql.V(), ""); err != nil {
+		t.Errorf("expected a valid filter, got %s", err)
+	}
+	if _, err := filterArg(map[string]any{ARG_FILTER: []any{"age"}}, testObjects, "patient", nil); err == nil {
+		t.Errorf("expected an error for a filter that is not an object")
+	}
+	if fb, err := filterArg(map[string]any{}, testObjects, "patient", nil); fb != nil || err != nil {
+		t.Errorf("expected no filter, got %v %v", fb, err)
+	}
+}
+
+func Test_FilterCoercion(t *testing.T) {
+	types := schemaFieldTypes(map[string]any{
+		"age":      "NUMERIC",
+		"code":     "STRING",
+		"deceased": "BOOL",
+		"alias":    "STRLIST",
+		"tags":     []any{"STRING"},
+		"address":  map[string]any{"city": "STRING"},
+	})
+	if len(types) != 5 || types["alias"] != "STRING" || types["tags"] != "STRING" {
+		t.Fatalf("unexpected field types %v", types)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		want   *gripql.HasExpression
+	}{
+		{"numeric string", `{">=": {"age": "66"}}`, gripql.Gte("age", 66.0)},
+		{"numeric list", `{"IN": {"age": ["66", 70]}}`, gripql.Within("age", 66.0, 70.0)},
+		{"string number", `{"=": {"code": 66}}`, gripql.Eq("code", "66")},
+		{"string float", `{"IN": {"code": [1.5, "x"]}}`, gripql.Within("code", "1.5", "x")},
+		{"bool string", `{"=": {"deceased": "true"}}`, gripql.Eq("deceased", true)},
+		{"list field", `{"IN": {"tags": [1]}}`, gripql.Within("tags", "1")},
+		{"untyped", `{"=": {"other": 1}}`, gripql.Eq("other", 1.0)},
+		{"exists", `{"exists": {"age": true}}`, gripql.Neq("age", nil)},
+		{"search", `{"search": {"keyword": "66", "fields": ["age"]}}`, gripql.Or(gripql.Eq("age", 66.0), gripql.Contains("age", 66.0))},
+	}
+	for _, c := range cases {
+		got, err := NewFilterBuilder(parseFilter(t, c.filter), nil, types).ExtendGrip(gripql.V(), "")
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if want := gripql.V().Has(c.want); !reflect.DeepEqual(got.Statements, want.Statements) {
+			t.Errorf("%s: expected %s, got %s", c.name, want.String(), got.String())
+		}
+	}
+
+	for filter, path := range map[string]string{
+		`{">=": {"age": "sixty"}}`:                                  "$[\">=\"].age",
+		`{"IN": {"deceased": [true, "maybe"]}}`:                     "$.IN.deceased",
+		`{"=": {"code": {"coding": "x"}}}`:                          "$[\"=\"].code",
+		`{"search": {"keyword": "flu", "fields": ["code", "age"]}}`: "$.search.fields[1]",
+	} {
+		_, err := NewFilterBuilder(parseFilter(t, filter), nil, types).ExtendGrip(gripql.V(), "")
+		fe, ok := err.(*FilterError)
+		if !ok || fe.Path != path || !strings.Contains(fe.Message, "cannot use") {
+			t.Errorf("%s: expected a coercion error at %s, got %v", filter, path, err)
+		}
+	}
+}
+
+var testObservation = graphql.NewObject(graphql.ObjectConfig{
+	Name: "observation",
+	Fields: graphql.Fields{
+		"id":    &graphql.Field{Type: graphql.String},
+		"code":  &graphql.Field{Type: graphql.String},
+		"value": &graphql.Field{Type: graphql.Float},
+	},
+})
+
+var testObjects = &objectMap{
+	objects: map[string]*graphql.Object{"patient": testPatient, "observation": testObservation},
+	edgeLabel: map[string]map[string]string{
+		"patient":     {"subject_observation": "subject_observation", "link_to_patient": "link"},
+		"observation": {"subject": "subject"},
+	},
+	edgeDstType: map[string]map[string]string{
+		"patient":     {"subject_observation": "observation", "link_to_patient": "patient"},
+		"observation": {"subject": "patient"},
+	},
+	fieldTypes: map[string]map[string]string{
+		"patient":     {"id": "STRING", "age": "NUMERIC", "birthDate": "STRING", "alias": "STRING"},
+		"observation": {"id": "STRING", "code": "STRING", "value": "NUMERIC"},
+	},
+}
+
+func Test_FilterNested(t *testing.T) {
+	base := func() *gripql.Query { return gripql.V().HasLabel("Patient") }
+	resources := []any{"/programs/a/projects/b"}
+	readable := gripql.Within("auth_resource_path", resources...)
+	cases := []struct {
+		name   string
+		filter string
+		want   *gripql.Query
+	}{
+		{"nested", `{"nested": {"path": "subject_observation", "AND": [{"=": {"code": 66}}, {">": {"value": "1.5"}}]}}`,
+			base().As("_nested1").Out("subject_observation").Has(readable).
+				Has(gripql.And(gripql.Eq("code", "66"), gripql.Gt("value", 1.5))).
+				Select("_nested1").Distinct("_gid")},
+		{"nested in and", `{"AND": [{">=": {"age": 18}}, {"nested": {"path": "subject_observation", "IN": {"code": ["a"]}}}]}`,
+			base().Has(gripql.Gte("age", 18.0)).As("_nested1").Out("subject_observation").Has(readable).
+				Has(gripql.Within("code", "a")).Select("_nested1").Distinct("_gid")},
+		{"any neighbor", `{"nested": {"path": "subject_observation"}}`,
+			base().As("_nested1").Out("subject_observation").Has(readable).Select("_nested1").Distinct("_gid")},
+		{"two levels", `{"nested": {"path": "subject_observation", "nested": {"path": "subject", "<": {"age": 30}}}}`,
+			base().As("_nested1").Out("subject_observation").Has(readable).
+				As("_nested2").Out("subject").Has(readable).Has(gripql.Lt("age", 30.0)).Select("_nested2").Distinct("_gid").
+				Select("_nested1").Distinct("_gid")},
+		{"label of several types", `{"nested": {"path": "link_to_patient", "=": {"id": "p2"}}}`,
+			base().As("_nested1").Out("link").HasLabel("Patient").Has(readable).Has(gripql.Eq("_gid", "p2")).Select("_nested1").Distinct("_gid")},
+	}
+	for _, c := range cases {
+		fb, err := filterArg(map[string]any{ARG_FILTER: parseFilter(t, c.filter)}, testObjects, "patient", resources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fb.ExtendGrip(base(), "")
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Statements, c.want.Statements) {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want.String(), got.String())
+		}
+	}
+
+	for filter, path := range map[string]string{
+		`{"nested": {"path": "observations", "=": {"code": "a"}}}`:                           "$.nested.path",
+		`{"OR": [{"=": {"age": 1}}, {"nested": {"path": "subject_observation"}}]}`:           "$.OR[1].nested",
+		`{"nested": {"path": "subject_observation", "=": {"age": 1}}}`:                       "$.nested[\"=\"].age",
+		`{"nested": {"path": "subject_observation", "nested": {"path": "subject_patient"}}}`: "$.nested.nested.path",
+	} {
+		fb, _ := filterArg(map[string]any{ARG_FILTER: parseFilter(t, filter)}, testObjects, "patient", nil)
+		_, err := fb.ExtendGrip(base(), "")
+		if fe, ok := err.(*FilterError); !ok || fe.Path != path {
+			t.Errorf("%s: expected an error at %s, got %v", filter, path, err)
+		}
+	}
+	if _, err := NewFilterBuilder(parseFilter(t, `{"nested": {"path": "subject_observation"}}`), nil, nil).ExtendGrip(base(), ""); err == nil {
+		t.Errorf("expected nested filters to be rejected without the object map")
+	}
+}
@@ -5,153 +5,115 @@ GraphQL Web endpoint
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
-    "sync"
-    "time"
-    "io"
-    "encoding/json"
-    "errors"
 
+	"github.com/bmeg/grip-endpoints/authz"
 	"github.com/bmeg/grip/gripql"
 	"github.com/bmeg/grip/log"
 	"github.com/graphql-go/handler"
 )
 
- type UserAuth struct {
-     ExpiresAt time.Time
-     AuthorizedResources []any
- }
-
- type TokenCache struct {
-     mu    sync.Mutex
-     cache map[string]UserAuth
- }
-
- func NewTokenCache() *TokenCache {
-     return &TokenCache{
-         cache: make(map[string]UserAuth),
-     }
- }
-
 // handle the graphql queries for a single endpoint
 type graphHandler struct {
-	graph      string
-	gqlHandler *handler.Handler
-	timestamp  string
-	client     gripql.Client
-    tokenCache *TokenCache
+	graph           string
+	gqlHandler      *handler.Handler
+	timestamp       string
+	client          gripql.Client
+	tokenCache      *TokenCache
+	authorizer      authz.Authorizer
+	verifier        *authz.Verifier
+	tierAccessLimit int
 	//schema     *gripql.Graph
 }
 
 // Handler is a GraphQL endpoint to query the Grip database
 type Handler struct {
-	handlers map[string]*graphHandler
-	client   gripql.Client
+	handlers        map[string]*graphHandler
+	client          gripql.Client
+	authorizer      authz.Authorizer
+	verifier        *authz.Verifier
+	tokenCache      *TokenCache
+	tierAccessLimit int
 }
 
 type ServerError struct {
-    StatusCode int
-    Message string
+	StatusCode int
+	Message    string
 }
 
 func (e *ServerError) Error() string {
-    return e.Message
+	return e.Message
 }
 
-func getAuthMappings(url string, token string) (any, error) {
-     GetRequest, err := http.NewRequest("GET", url, nil)
-     if err != nil {
-         log.Error(err)
-         return nil, err
-     }
-
-     GetRequest.Header.Set("Authorization", token)
-     GetRequest.Header.Set("Accept", "application/json")
-     fetchedData, err := http.DefaultClient.Do(GetRequest)
-     if err != nil {
-         log.Error(err)
-         return nil, err
-     }
-     defer fetchedData.Body.Close()
-
-     if fetchedData.StatusCode == http.StatusOK {
-         bodyBytes, err := io.ReadAll(fetchedData.Body)
-         if err != nil {
-             log.Error(err)
-         }
-
-         var parsedData any
-         err = json.Unmarshal(bodyBytes, &parsedData)
-         if err != nil {
-             log.Error(err)
-             return nil, err
-         }
-         return parsedData, nil
-
-     }
-     // code must be nonNull to get here, probably don't want to cache a failed state
-     empty_map :=  make(map[string]any)
-     err = errors.New("Arborist auth/mapping GET returned a non-200 status code: " + fetchedData.Status)
-     return empty_map, err
- }
-
- func hasPermission(permissions []any) bool {
-     for _, permission := range permissions {
-         permission := permission.(map[string]any)
-         if (permission["service"] == "*" || permission["service"] == "peregrine") &&
-             (permission["method"] == "*" || permission["method"] == "read") {
-             // fmt.Println("PERMISSIONS: ", permission)
-             return true
-         }
-     }
-     return false
- }
-
- func getAllowedProjects(url string, token string) ([]any, error) {
-     var readAccessResources []string
-     authMappings, err := getAuthMappings(url, token)
-     if err != nil {
-         return nil, err
-     }
-
-     // Iterate through /auth/mapping resultant dict checking for valid read permissions
-     for resourcePath, permissions := range authMappings.(map[string]any) {
-         if hasPermission(permissions.([]any)) {
-             readAccessResources = append(readAccessResources, resourcePath)
-         }
-     }
-
-     s := make([]interface{}, len(readAccessResources))
-     for i, v := range readAccessResources {
-         s[i] = v
-     }
-     return s, nil
- }
-
- func handleError(err error, writer http.ResponseWriter) {
-    if ae, ok := err.(*ServerError); ok {
-        response := ServerError{StatusCode: ae.StatusCode, Message: ae.Message}
-        jsonResponse, _ := json.Marshal(response)
-        writer.WriteHeader(ae.StatusCode)
-        writer.Write(jsonResponse)
-    }else {
-        response := ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("General error occured while setting up graphql handler")}
-        jsonResponse, _ := json.Marshal(response)
-        writer.WriteHeader(http.StatusInternalServerError)
-        writer.Write(jsonResponse)
-    }
+func handleError(err error, writer http.ResponseWriter) {
+	if ae, ok := err.(*ServerError); ok {
+		response := ServerError{StatusCode: ae.StatusCode, Message: ae.Message}
+		jsonResponse, _ := json.Marshal(response)
+		writer.WriteHeader(ae.StatusCode)
+		writer.Write(jsonResponse)
+	} else {
+		response := ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("General error occured while setting up graphql handler")}
+		jsonResponse, _ := json.Marshal(response)
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write(jsonResponse)
+	}
 }
 
 // NewClientHTTPHandler initilizes a new GraphQLHandler
 func NewHTTPHandler(client gripql.Client, config map[string]string) (http.Handler, error) {
+	// reads are authorized against the peregrine service, as in the gen3 data portal
+	authorizer, err := authz.New(config, "peregrine")
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := authz.NewVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+	tokenCache, err := NewTokenCacheFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tierAccessLimit, err := parseTierAccessLimit(config)
+	if err != nil {
+		return nil, err
+	}
 	h := &Handler{
-		client:   client,
-		handlers: map[string]*graphHandler{},
+		client:          client,
+		handlers:        map[string]*graphHandler{},
+		authorizer:      authorizer,
+		verifier:        verifier,
+		tokenCache:      tokenCache,
+		tierAccessLimit: tierAccessLimit,
 	}
 	return h, nil
 }
 
+// metricsPath serves the plugin's counters instead of a graph
+const metricsPath = "_metrics"
+
+// metricsAccess checks the token of a metrics request like that of a graph request: it must be
+// verified and grant read access to at least one resource
+func (gh *Handler) metricsAccess(headers http.Header) error {
+	token := headers.Get("Authorization")
+	if token == "" {
+		return &ServerError{StatusCode: http.StatusUnauthorized, Message: "No authorization header provided."}
+	}
+	if err := gh.verifier.Verify(token); err != nil {
+		return &ServerError{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("%s", err)}
+	}
+	resources, err := gh.authorizer.Resources(token, "read")
+	if err != nil {
+		return &ServerError{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("%s", err)}
+	}
+	if len(resources) == 0 {
+		return &ServerError{StatusCode: http.StatusForbidden, Message: "No read access to any resource."}
+	}
+	return nil
+}
+
 // Static HTML that links to Apollo GraphQL query editor
 var sandBox = `
 <div id="sandbox" style="position:absolute;top:0;right:0;bottom:0;left:0"></div>
@@ -174,6 +136,16 @@ func (gh *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		writer.Write([]byte(sandBox))
 		return
 	}
+	if request.URL.Path == metricsPath {
+		if err := gh.metricsAccess(request.Header); err != nil {
+			handleError(err, writer)
+			return
+		}
+		jsonResponse, _ := json.Marshal(map[string]any{"token_cache": gh.tokenCache.Stats()})
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+		return
+	}
 	//pathRE := regexp.MustCompile("/(.+)$")
 	//graphName := pathRE.FindStringSubmatch(request.URL.Path)[1]
 	graphName := request.URL.Path
@@ -182,36 +154,38 @@ func (gh *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 	if handler, ok = gh.handlers[graphName]; ok {
 		//Call the setup function. If nothing has changed it will return without doing anything
 		err := handler.setup(request.Header)
-        if err != nil{
-            handleError(err, writer)
-            return
-        }
+		if err != nil {
+			handleError(err, writer)
+			return
+		}
 	} else {
-        tokenCache := NewTokenCache()
 		//Graph handler was not found, so we'll need to set it up
 		var err error
-		handler, err = newGraphHandler(graphName, gh.client, request.Header, tokenCache)
-        if err != nil{
-            handleError(err, writer)
-            return
-        }
+		handler, err = newGraphHandler(graphName, gh.client, request.Header, gh.tokenCache, gh.authorizer, gh.verifier, gh.tierAccessLimit)
+		if err != nil {
+			handleError(err, writer)
+			return
+		}
 		gh.handlers[graphName] = handler
 	}
 	if handler != nil && handler.gqlHandler != nil {
 		handler.gqlHandler.ServeHTTP(writer, request)
 	} else {
-         response := ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("General error occured while setting up graphql handler")}
-         jsonResponse, _ := json.Marshal(response)
-         writer.Write(jsonResponse)
+		response := ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("General error occured while setting up graphql handler")}
+		jsonResponse, _ := json.Marshal(response)
+		writer.Write(jsonResponse)
 	}
 }
 
 // newGraphHandler creates a new graphql handler from schema
-func newGraphHandler(graph string, client gripql.Client, headers http.Header, userCache *TokenCache) (*graphHandler, error) {
+func newGraphHandler(graph string, client gripql.Client, headers http.Header, userCache *TokenCache, authorizer authz.Authorizer, verifier *authz.Verifier, tierAccessLimit int) (*graphHandler, error) {
 	o := &graphHandler{
-		graph:  graph,
-		client: client,
-        tokenCache: userCache,
+		graph:           graph,
+		client:          client,
+		tokenCache:      userCache,
+		authorizer:      authorizer,
+		verifier:        verifier,
+		tierAccessLimit: tierAccessLimit,
 	}
 	err := o.setup(headers)
 	if err != nil {
@@ -220,60 +194,58 @@ func newGraphHandler(graph string, client gripql.Client, headers http.Header, us
 	return o, nil
 }
 
-// LookupToken looks up a user token in the cache based on the token string.
-// but resource lists can change when users are given new permissions so it's probably better not to cache resourceLists
-func (tc *TokenCache) LookupResourceList(token string) ([]any) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
-	auth, _:= tc.cache[token]
-    var resourceList []any
-    if auth.AuthorizedResources != nil {
-        resourceList = auth.AuthorizedResources
-    }
-	return resourceList
-}
-
 // Check timestamp to see if schema needs to be updated or if the access token has changed
 // If so rebuild the schema
 func (gh *graphHandler) setup(headers http.Header) error {
-    // Check if Authorization header is present
-    authHeaders, ok := headers["Authorization"]
-    if !ok || len(authHeaders) == 0 {
-        return &ServerError{StatusCode: http.StatusUnauthorized, Message: "No authorization header provided."}
-    }
-    authToken := authHeaders[0]
-
-    ts, _ := gh.client.GetTimestamp(gh.graph)
-    fmt.Println("HEADERS: ", headers)
+	// Check if Authorization header is present
+	authHeaders, ok := headers["Authorization"]
+	if !ok || len(authHeaders) == 0 {
+		return &ServerError{StatusCode: http.StatusUnauthorized, Message: "No authorization header provided."}
+	}
+	authToken := authHeaders[0]
+	// a forged or expired token is rejected before the authorizer or token cache see it
+	if err := gh.verifier.Verify(authToken); err != nil {
+		log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Info("token verification failed")
+		return &ServerError{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("%s", err)}
+	}
 
-    resourceList, err := getAllowedProjects("http://arborist-service/auth/mapping", authToken)
-    if err != nil {
-        log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("auth/mapping fetch and processing step failed")
-        return  &ServerError{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("%s", err)}
-    }
+	ts, _ := gh.client.GetTimestamp(gh.graph)
+
+	resourceList, cached := gh.tokenCache.LookupResourceList(authToken)
+	if !cached {
+		resources, err := gh.authorizer.Resources(authToken, "read")
+		if err != nil {
+			log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("auth/mapping fetch and processing step failed")
+			return &ServerError{StatusCode: http.StatusUnauthorized, Message: fmt.Sprintf("%s", err)}
+		}
+		resourceList = make([]any, len(resources))
+		for i, r := range resources {
+			resourceList[i] = r
+		}
+		gh.tokenCache.Store(authToken, resourceList)
+	}
 
-    if ts == nil || ts.Timestamp != gh.timestamp || resourceList != nil {
-        fmt.Println("YOU ARE HERE +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++", resourceList)
-        log.WithFields(log.Fields{"graph": gh.graph}).Info("Reloading GraphQL schema")
-        schema, err := gh.client.GetSchema(gh.graph)
-        if err != nil {
-            log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("GetSchema error")
-            return  &ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("%s", err)}
-        }
-        gqlSchema, err := buildGraphQLSchema(schema, gh.client, gh.graph, resourceList)
-        if err != nil {
-            log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("GraphQL schema build failed")
-            gh.gqlHandler = nil
-            gh.timestamp = ""
-            return &ServerError{StatusCode: http.StatusInternalServerError, Message: "GraphQL schema build failed"}
-        } else {
-            log.WithFields(log.Fields{"graph": gh.graph}).Info("Built GraphQL schema")
-            gh.gqlHandler = handler.New(&handler.Config{
-                Schema: gqlSchema,
-            })
-            gh.timestamp = ts.Timestamp
-        }
-    }
+	if ts == nil || ts.Timestamp != gh.timestamp || resourceList != nil {
+		log.WithFields(log.Fields{"graph": gh.graph}).Info("Reloading GraphQL schema")
+		schema, err := gh.client.GetSchema(gh.graph)
+		if err != nil {
+			log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("GetSchema error")
+			return &ServerError{StatusCode: http.StatusInternalServerError, Message: fmt.Sprintf("%s", err)}
+		}
+		gqlSchema, err := buildGraphQLSchema(schema, gh.client, gh.graph, resourceList, gh.tierAccessLimit)
+		if err != nil {
+			log.WithFields(log.Fields{"graph": gh.graph, "error": err}).Error("GraphQL schema build failed")
+			gh.gqlHandler = nil
+			gh.timestamp = ""
+			return &ServerError{StatusCode: http.StatusInternalServerError, Message: "GraphQL schema build failed"}
+		} else {
+			log.WithFields(log.Fields{"graph": gh.graph}).Info("Built GraphQL schema")
+			gh.gqlHandler = handler.New(&handler.Config{
+				Schema: gqlSchema,
+			})
+			gh.timestamp = ts.Timestamp
+		}
+	}
 
-    return nil
+	return nil
 }
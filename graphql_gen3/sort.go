@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql"
+)
+
+// sortKey is a single field of a Guppy sort spec
+type sortKey struct {
+	Field      string
+	Descending bool
+}
+
+// sortableFields returns the scalar fields of an object, the only fields results can be sorted by
+func sortableFields(obj *graphql.Object) []string {
+	out := []string{}
+	for k, v := range obj.Fields() {
+		switch v.Type {
+		case graphql.String, graphql.Int, graphql.Float, graphql.Boolean:
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// parseSort reads a Guppy sort spec, either a list of single field objects such as
+// [{"birthDate": "desc"}, {"id": "asc"}] or one object {"birthDate": "desc"}. The fields are
+// checked against the object, and id is appended as the last key so rows never tie
+func parseSort(arg any, obj *graphql.Object) ([]sortKey, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	var specs []any
+	switch v := arg.(type) {
+	case []any:
+		specs = v
+	case map[string]any:
+		// a single object keeps its keys in no particular order, so it may only name one field
+		if len(v) > 1 {
+			return nil, fmt.Errorf("sort: an object can only name one field, use a list such as [{\"a\": \"asc\"}, {\"b\": \"desc\"}] to sort by several")
+		}
+		specs = []any{v}
+	default:
+		return nil, fmt.Errorf("sort: expected a list of {\"field\": \"asc\"|\"desc\"} objects, got %v", arg)
+	}
+	fields := sortableFields(obj)
+	allowed := map[string]bool{}
+	for _, f := range fields {
+		allowed[f] = true
+	}
+	keys := []sortKey{}
+	seen := map[string]bool{}
+	for i, spec := range specs {
+		m, ok := spec.(map[string]any)
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("sort[%d]: expected a single {\"field\": \"asc\"|\"desc\"} object, got %v", i, spec)
+		}
+		for field, order := range m {
+			if !allowed[field] {
+				return nil, fmt.Errorf("sort[%d]: %s has no sortable field '%s', allowed fields are: %s", i, obj.Name(), field, strings.Join(fields, ", "))
+			}
+			o, _ := order.(string)
+			switch strings.ToLower(o) {
+			case "asc":
+				keys = append(keys, sortKey{Field: field})
+			case "desc":
+				keys = append(keys, sortKey{Field: field, Descending: true})
+			default:
+				return nil, fmt.Errorf("sort[%d]: order of '%s' must be asc or desc, got %v", i, field, order)
+			}
+			seen[field] = true
+		}
+	}
+	if !seen["id"] {
+		keys = append(keys, sortKey{Field: "id"})
+	}
+	return keys, nil
+}
+
+// rowKeyValues returns the values of a rendered row for the sort keys
+func rowKeyValues(row any, keys []sortKey) []any {
+	m, _ := row.(map[string]any)
+	out := make([]any, len(keys))
+	for i, k := range keys {
+		out[i] = m[k.Field]
+	}
+	return out
+}
+
+// sortQuery orders a query by the keys, so grip sorts the matching vertices ahead of the skip and
+// limit of a page instead of every row being read and sorted here
+func sortQuery(q *gripql.Query, keys []sortKey) *gripql.Query {
+	fields := make([]*gripql.SortField, len(keys))
+	for i, k := range keys {
+		fields[i] = &gripql.SortField{Field: fieldMap(k.Field), Descending: k.Descending}
+	}
+	return q.Sort(fields...)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bmeg/grip/gripql"
+	"github.com/graphql-go/graphql"
+)
+
+var testPatient = graphql.NewObject(graphql.ObjectConfig{
+	Name: "patient",
+	Fields: graphql.Fields{
+		"id":        &graphql.Field{Type: graphql.String},
+		"birthDate": &graphql.Field{Type: graphql.String},
+		"age":       &graphql.Field{Type: graphql.Float},
+		"alias":     &graphql.Field{Type: graphql.NewList(graphql.String)},
+	},
+})
+
+func Test_SortParse(t *testing.T) {
+	cases := []struct {
+		arg  any
+		keys string
+		err  string
+	}{
+		{nil, "[]", ""},
+		{[]any{map[string]any{"birthDate": "desc"}, map[string]any{"id": "asc"}}, "[{birthDate true} {id false}]", ""},
+		{map[string]any{"age": "ASC"}, "[{age false} {id false}]", ""},
+		{[]any{map[string]any{"gender": "asc"}}, "", "allowed fields are: age, birthDate, id"},
+		{[]any{map[string]any{"alias": "asc"}}, "", "no sortable field 'alias'"},
+		{[]any{map[string]any{"age": "up"}}, "", "must be asc or desc"},
+		{map[string]any{"age": "asc", "id": "desc"}, "", "only name one field"},
+		{"age", "", "expected a list"},
+	}
+	for _, c := range cases {
+		keys, err := parseSort(c.arg, testPatient)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: expected error containing %q, got %v", c.arg, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", c.arg, err)
+		} else if got := fmt.Sprint(keys); got != c.keys {
+			t.Errorf("%v: expected %s, got %s", c.arg, c.keys, got)
+		}
+	}
+}
+
+func Test_SortQuery(t *testing.T) {
+	keys, _ := parseSort([]any{map[string]any{"birthDate": "desc"}}, testPatient)
+	got := sortQuery(gripql.V().HasLabel("Patient"), keys)
+	want := gripql.V().HasLabel("Patient").Sort(
+		&gripql.SortField{Field: "birthDate", Descending: true},
+		&gripql.SortField{Field: "_gid"},
+	)
+	if !reflect.DeepEqual(got.Statements, want.Statements) {
+		t.Errorf("expected %v, got %v", want.Statements, got.Statements)
+	}
+}
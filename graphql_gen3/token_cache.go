@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmeg/grip-endpoints/authz"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultTokenCacheTTL  = 5 * time.Minute
+	defaultTokenCacheSize = 10000
+)
+
+type UserAuth struct {
+	ExpiresAt           time.Time
+	AuthorizedResources []any
+}
+
+// TokenCache caches the resource list of each token so a burst of queries costs a single
+// authorization lookup. Entries are keyed by a hash of the token, so tokens are not kept in
+// memory, and expire at the earlier of the token's exp claim and the cache TTL.
+type TokenCache struct {
+	mu      sync.Mutex
+	cache   map[string]UserAuth
+	ttl     time.Duration
+	maxSize int
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// TokenCacheStats are the counters of a TokenCache
+type TokenCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+}
+
+func NewTokenCache(ttl time.Duration, maxSize int) *TokenCache {
+	return &TokenCache{
+		cache:   make(map[string]UserAuth),
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+}
+
+// NewTokenCacheFromConfig reads the token_cache_ttl (a duration, 0 disables the cache)
+// and token_cache_size entries of the plugin config
+func NewTokenCacheFromConfig(config map[string]string) (*TokenCache, error) {
+	ttl := defaultTokenCacheTTL
+	if v, ok := config["token_cache_ttl"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("token_cache_ttl must be a non-negative duration such as '5m', got '%s'", v)
+		}
+		ttl = d
+	}
+	size := defaultTokenCacheSize
+	if v, ok := config["token_cache_size"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("token_cache_size must be a positive integer, got '%s'", v)
+		}
+		size = n
+	}
+	return NewTokenCache(ttl, size), nil
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpiry returns the exp claim of a JWT, if it has one
+func tokenExpiry(token string) (time.Time, bool) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(authz.BearerToken(token), claims); err != nil {
+		return time.Time{}, false
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}, false
+	}
+	return exp.Time, true
+}
+
+// LookupResourceList returns the cached resource list of a token, false if it is not
+// cached or has expired
+func (tc *TokenCache) LookupResourceList(token string) ([]any, bool) {
+	key := tokenKey(token)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	auth, ok := tc.cache[key]
+	if ok && time.Now().Before(auth.ExpiresAt) {
+		tc.hits.Add(1)
+		return auth.AuthorizedResources, true
+	}
+	if ok {
+		delete(tc.cache, key)
+	}
+	tc.misses.Add(1)
+	return nil, false
+}
+
+// Store caches the resource list of a token
+func (tc *TokenCache) Store(token string, resources []any) {
+	if tc.ttl == 0 {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(tc.ttl)
+	if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+		expires = exp
+	}
+	if !expires.After(now) {
+		return
+	}
+	key := tokenKey(token)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.cache[key]; !ok && len(tc.cache) >= tc.maxSize {
+		tc.evict(now)
+	}
+	tc.cache[key] = UserAuth{ExpiresAt: expires, AuthorizedResources: resources}
+}
+
+// evict drops the expired entries, or if there are none the entry closest to expiring
+func (tc *TokenCache) evict(now time.Time) {
+	var soonest string
+	var soonestAt time.Time
+	removed := 0
+	for k, auth := range tc.cache {
+		if !now.Before(auth.ExpiresAt) {
+			delete(tc.cache, k)
+			removed++
+		} else if soonest == "" || auth.ExpiresAt.Before(soonestAt) {
+			soonest, soonestAt = k, auth.ExpiresAt
+		}
+	}
+	if removed == 0 && soonest != "" {
+		delete(tc.cache, soonest)
+		removed++
+	}
+	tc.evictions.Add(int64(removed))
+}
+
+func (tc *TokenCache) Stats() TokenCacheStats {
+	tc.mu.Lock()
+	entries := len(tc.cache)
+	tc.mu.Unlock()
+	return TokenCacheStats{
+		Hits:      tc.hits.Load(),
+		Misses:    tc.misses.Load(),
+		Evictions: tc.evictions.Load(),
+		Entries:   entries,
+	}
+}
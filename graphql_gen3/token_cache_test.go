@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmeg/grip-endpoints/authz"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signedToken(t *testing.T, exp time.Time) string {
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp.Unix()}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + s
+}
+
+func Test_TokenCacheHitsAndMisses(t *testing.T) {
+	tc := NewTokenCache(time.Minute, 10)
+	token := signedToken(t, time.Now().Add(time.Hour))
+	if _, ok := tc.LookupResourceList(token); ok {
+		t.Error("empty cache returned a hit")
+	}
+	tc.Store(token, []any{"/programs/a"})
+	for i := 0; i < 3; i++ {
+		if r, ok := tc.LookupResourceList(token); !ok || len(r) != 1 {
+			t.Errorf("expected a cached resource list, got %v %v", r, ok)
+		}
+	}
+	if s := tc.Stats(); s.Hits != 3 || s.Misses != 1 || s.Entries != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	for k := range tc.cache {
+		if k == token {
+			t.Error("token stored in clear")
+		}
+	}
+}
+
+func Test_TokenCacheExpiry(t *testing.T) {
+	tc := NewTokenCache(time.Hour, 10)
+	// the token expires before the TTL so it bounds the entry
+	token := signedToken(t, time.Now().Add(2*time.Second))
+	tc.Store(token, []any{})
+	if exp := tc.cache[tokenKey(token)].ExpiresAt; time.Until(exp) > 3*time.Second {
+		t.Errorf("entry expires at %s, after the token", exp)
+	}
+	expired := signedToken(t, time.Now().Add(-time.Second))
+	tc.Store(expired, []any{})
+	if _, ok := tc.LookupResourceList(expired); ok {
+		t.Error("expired token was cached")
+	}
+	tc = NewTokenCache(0, 10)
+	tc.Store(token, []any{})
+	if _, ok := tc.LookupResourceList(token); ok {
+		t.Error("a zero TTL should disable the cache")
+	}
+}
+
+func Test_TokenCacheBounded(t *testing.T) {
+	tc := NewTokenCache(time.Hour, 3)
+	for i := 0; i < 5; i++ {
+		tc.Store(signedToken(t, time.Now().Add(time.Duration(i+1)*time.Minute)), []any{})
+	}
+	if s := tc.Stats(); s.Entries != 3 || s.Evictions != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func Test_TokenCacheConfig(t *testing.T) {
+	if _, err := NewTokenCacheFromConfig(map[string]string{"token_cache_ttl": "soon"}); err == nil {
+		t.Error("expected an error for an invalid ttl")
+	}
+	if _, err := NewTokenCacheFromConfig(map[string]string{"token_cache_size": "0"}); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+	tc, err := NewTokenCacheFromConfig(map[string]string{"token_cache_ttl": "30s"})
+	if err != nil || tc.ttl != 30*time.Second || tc.maxSize != defaultTokenCacheSize {
+		t.Errorf("unexpected cache %+v %v", tc, err)
+	}
+}
+
+// noResources grants no resource to any token
+type noResources struct{}
+
+func (noResources) Resources(token string, method string) ([]string, error) {
+	return []string{}, nil
+}
+
+func Test_TokenCacheMetrics(t *testing.T) {
+	static, err := authz.New(map[string]string{"authz": "static"}, "peregrine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signedToken(t, time.Now().Add(time.Hour))
+	for _, c := range []struct {
+		name       string
+		authorizer authz.Authorizer
+		token      string
+		code       int
+	}{
+		{"no token", static, "", http.StatusUnauthorized},
+		{"no resources", noResources{}, token, http.StatusForbidden},
+		{"reader", static, token, http.StatusOK},
+	} {
+		h := &Handler{authorizer: c.authorizer, tokenCache: NewTokenCache(time.Minute, 10)}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = metricsPath
+		if c.token != "" {
+			req.Header.Set("Authorization", c.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+}